@@ -4,23 +4,92 @@
 package apiclient
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/deepmap/oapi-codegen/pkg/runtime"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
+// FailureReason defines model for FailureReason.
+type FailureReason string
+
 // PodHealth defines model for PodHealth.
 type PodHealth struct {
-	ErrorCount int32  `json:"errorCount"`
-	IsDeleted  bool   `json:"isDeleted"`
-	IsHealthy  bool   `json:"isHealthy"`
-	Namespace  string `json:"namespace"`
-	PodName    string `json:"podName"`
+
+	// Number of attempts to restart the pod
+	DeleteAttempts *int32 `json:"deleteAttempts,omitempty"`
+	ErrorCount     int32  `json:"errorCount"`
+	IsDeleted      bool   `json:"isDeleted"`
+	IsHealthy      bool   `json:"isHealthy"`
+
+	// The pod has not reported its health for a while
+	IsStale bool `json:"isStale"`
+
+	// Error of the last failed attempt to restart the pod
+	LastDeleteError *string `json:"lastDeleteError,omitempty"`
+	Namespace       string  `json:"namespace"`
+
+	// Time of the next attempt to restart the pod
+	NextDeleteRetry *time.Time `json:"nextDeleteRetry,omitempty"`
+	PodName         string     `json:"podName"`
+
+	// The action taken to restart the pod
+	RemediationAction *string `json:"remediationAction,omitempty"`
+
+	// The last reports of the pod, oldest first
+	Reports *[]ProbeReport `json:"reports,omitempty"`
+
+	// Health of the named volumes of the pod
+	Volumes *[]VolumeHealth `json:"volumes,omitempty"`
+
+	// The pod would have been restarted if dry-run mode was disabled
+	WouldRestart bool `json:"wouldRestart"`
+}
+
+// ProbeReport defines model for ProbeReport.
+type ProbeReport struct {
+	BytesWritten *int64  `json:"bytesWritten,omitempty"`
+	IsHealthy    bool    `json:"isHealthy"`
+	LatencyMs    *int64  `json:"latencyMs,omitempty"`
+	Message      *string `json:"message,omitempty"`
+
+	// Why a volume is unhealthy. Volumes that are full are not remediated by restarting the pod.
+	Reason     *FailureReason `json:"reason,omitempty"`
+	Time       time.Time      `json:"time"`
+	VolumeName *string        `json:"volumeName,omitempty"`
+}
+
+// ProbeResult defines model for ProbeResult.
+type ProbeResult struct {
+
+	// Number of bytes written by the probe
+	BytesWritten *int64 `json:"bytesWritten,omitempty"`
+
+	// Duration of the probe in milliseconds
+	LatencyMs *int64 `json:"latencyMs,omitempty"`
+
+	// Error of the failed probe
+	Message *string `json:"message,omitempty"`
+
+	// Why a volume is unhealthy. Volumes that are full are not remediated by restarting the pod.
+	Reason *FailureReason `json:"reason,omitempty"`
+}
+
+// VolumeHealth defines model for VolumeHealth.
+type VolumeHealth struct {
+	ErrorCount int32 `json:"errorCount"`
+	IsHealthy  bool  `json:"isHealthy"`
+
+	// Why a volume is unhealthy. Volumes that are full are not remediated by restarting the pod.
+	Reason     *FailureReason `json:"reason,omitempty"`
+	VolumeName string         `json:"volumeName"`
 }
 
 // DeleteHealthParams defines parameters for DeleteHealth.
@@ -33,6 +102,9 @@ type DeleteHealthParams struct {
 	Namespace string `json:"namespace"`
 }
 
+// PostHealthJSONBody defines parameters for PostHealth.
+type PostHealthJSONBody ProbeResult
+
 // PostHealthParams defines parameters for PostHealth.
 type PostHealthParams struct {
 
@@ -44,8 +116,17 @@ type PostHealthParams struct {
 
 	// Namespace the pod is in
 	Namespace string `json:"namespace"`
+
+	// UID of the pod
+	PodUid *string `json:"podUid,omitempty"`
+
+	// Name of the checked volume
+	VolumeName *string `json:"volumeName,omitempty"`
 }
 
+// PostHealthRequestBody defines body for PostHealth for application/json ContentType.
+type PostHealthJSONRequestBody PostHealthJSONBody
+
 // RequestEditorFn  is the function signature for the RequestEditor callback function
 type RequestEditorFn func(ctx context.Context, req *http.Request) error
 
@@ -123,8 +204,10 @@ type ClientInterface interface {
 	// GetHealth request
 	GetHealth(ctx context.Context) (*http.Response, error)
 
-	// PostHealth request
-	PostHealth(ctx context.Context, params *PostHealthParams) (*http.Response, error)
+	// PostHealth request  with any body
+	PostHealthWithBody(ctx context.Context, params *PostHealthParams, contentType string, body io.Reader) (*http.Response, error)
+
+	PostHealth(ctx context.Context, params *PostHealthParams, body PostHealthJSONRequestBody) (*http.Response, error)
 }
 
 func (c *Client) DeleteHealth(ctx context.Context, params *DeleteHealthParams) (*http.Response, error) {
@@ -157,8 +240,23 @@ func (c *Client) GetHealth(ctx context.Context) (*http.Response, error) {
 	return c.Client.Do(req)
 }
 
-func (c *Client) PostHealth(ctx context.Context, params *PostHealthParams) (*http.Response, error) {
-	req, err := NewPostHealthRequest(c.Server, params)
+func (c *Client) PostHealthWithBody(ctx context.Context, params *PostHealthParams, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := NewPostHealthRequestWithBody(c.Server, params, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if c.RequestEditor != nil {
+		err = c.RequestEditor(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.Client.Do(req)
+}
+
+func (c *Client) PostHealth(ctx context.Context, params *PostHealthParams, body PostHealthJSONRequestBody) (*http.Response, error) {
+	req, err := NewPostHealthRequest(c.Server, params, body)
 	if err != nil {
 		return nil, err
 	}
@@ -254,8 +352,19 @@ func NewGetHealthRequest(server string) (*http.Request, error) {
 	return req, nil
 }
 
-// NewPostHealthRequest generates requests for PostHealth
-func NewPostHealthRequest(server string, params *PostHealthParams) (*http.Request, error) {
+// NewPostHealthRequest calls the generic PostHealth builder with application/json body
+func NewPostHealthRequest(server string, params *PostHealthParams, body PostHealthJSONRequestBody) (*http.Request, error) {
+	var bodyReader io.Reader
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	bodyReader = bytes.NewReader(buf)
+	return NewPostHealthRequestWithBody(server, params, "application/json", bodyReader)
+}
+
+// NewPostHealthRequestWithBody generates requests for PostHealth with any type of body
+func NewPostHealthRequestWithBody(server string, params *PostHealthParams, contentType string, body io.Reader) (*http.Request, error) {
 	var err error
 
 	queryUrl, err := url.Parse(server)
@@ -311,13 +420,46 @@ func NewPostHealthRequest(server string, params *PostHealthParams) (*http.Reques
 		}
 	}
 
+	if params.PodUid != nil {
+
+		if queryFrag, err := runtime.StyleParam("form", true, "podUid", *params.PodUid); err != nil {
+			return nil, err
+		} else if parsed, err := url.ParseQuery(queryFrag); err != nil {
+			return nil, err
+		} else {
+			for k, v := range parsed {
+				for _, v2 := range v {
+					queryValues.Add(k, v2)
+				}
+			}
+		}
+
+	}
+
+	if params.VolumeName != nil {
+
+		if queryFrag, err := runtime.StyleParam("form", true, "volumeName", *params.VolumeName); err != nil {
+			return nil, err
+		} else if parsed, err := url.ParseQuery(queryFrag); err != nil {
+			return nil, err
+		} else {
+			for k, v := range parsed {
+				for _, v2 := range v {
+					queryValues.Add(k, v2)
+				}
+			}
+		}
+
+	}
+
 	queryUrl.RawQuery = queryValues.Encode()
 
-	req, err := http.NewRequest("POST", queryUrl.String(), nil)
+	req, err := http.NewRequest("POST", queryUrl.String(), body)
 	if err != nil {
 		return nil, err
 	}
 
+	req.Header.Add("Content-Type", contentType)
 	return req, nil
 }
 
@@ -430,9 +572,17 @@ func (c *ClientWithResponses) GetHealthWithResponse(ctx context.Context) (*getHe
 	return ParseGetHealthResponse(rsp)
 }
 
-// PostHealthWithResponse request returning *PostHealthResponse
-func (c *ClientWithResponses) PostHealthWithResponse(ctx context.Context, params *PostHealthParams) (*postHealthResponse, error) {
-	rsp, err := c.PostHealth(ctx, params)
+// PostHealthWithBodyWithResponse request with arbitrary body returning *PostHealthResponse
+func (c *ClientWithResponses) PostHealthWithBodyWithResponse(ctx context.Context, params *PostHealthParams, contentType string, body io.Reader) (*postHealthResponse, error) {
+	rsp, err := c.PostHealthWithBody(ctx, params, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePostHealthResponse(rsp)
+}
+
+func (c *ClientWithResponses) PostHealthWithResponse(ctx context.Context, params *PostHealthParams, body PostHealthJSONRequestBody) (*postHealthResponse, error) {
+	rsp, err := c.PostHealth(ctx, params, body)
 	if err != nil {
 		return nil, err
 	}
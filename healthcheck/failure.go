@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/derfetzer/longhorn-monitor/healthcheck/apiclient"
+)
+
+const mountInfoPath = "/proc/self/mountinfo"
+
+// Reasons sent to the monitor for unhealthy volumes.
+const (
+	reasonReadOnly         apiclient.FailureReason = "read-only"
+	reasonDiskFull         apiclient.FailureReason = "disk-full"
+	reasonIOError          apiclient.FailureReason = "io-error"
+	reasonTimeout          apiclient.FailureReason = "timeout"
+	reasonSlowIO           apiclient.FailureReason = "slow-io"
+	reasonHungIO           apiclient.FailureReason = "hung-io"
+	reasonPermissionDenied apiclient.FailureReason = "permission-denied"
+	reasonUnknown          apiclient.FailureReason = "unknown"
+)
+
+// failureReason classifies the error of a failed probe of the volume. A
+// volume that was remounted read-only, e.g. by ext4 after I/O errors, is
+// detected from the mount options even if the probe failed differently.
+func failureReason(path string, err error) apiclient.FailureReason {
+	f, openErr := os.Open(mountInfoPath)
+	if openErr == nil {
+		defer f.Close()
+		readOnly, found := isReadOnlyMount(f, path)
+		if found && readOnly {
+			return reasonReadOnly
+		}
+	}
+
+	return classifyError(err)
+}
+
+func classifyError(err error) apiclient.FailureReason {
+	switch {
+	case errors.Is(err, syscall.EROFS):
+		return reasonReadOnly
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return reasonDiskFull
+	case errors.Is(err, syscall.EIO):
+		return reasonIOError
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return reasonPermissionDenied
+	}
+	return reasonUnknown
+}
+
+// isReadOnlyMount returns whether the mount containing the path is read-only,
+// either as mount or as filesystem, and whether the mount was found in the
+// mountinfo.
+func isReadOnlyMount(mountInfo io.Reader, path string) (bool, bool) {
+	path = filepath.Clean(path)
+
+	var readOnly, found bool
+	var mountPointLength int
+	scanner := bufio.NewScanner(mountInfo)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		separator := -1
+		for i, field := range fields {
+			if field == "-" {
+				separator = i
+				break
+			}
+		}
+		if separator < 6 || len(fields) < separator+4 {
+			continue
+		}
+
+		mountPoint := unescapeMountInfo(fields[4])
+		if !containsPath(mountPoint, path) || len(mountPoint) < mountPointLength {
+			continue
+		}
+
+		// Later entries mount over earlier ones with the same mount point.
+		mountPointLength = len(mountPoint)
+		found = true
+		readOnly = hasOption(fields[5], "ro") || hasOption(fields[separator+3], "ro")
+	}
+	return readOnly, found
+}
+
+func containsPath(mountPoint, path string) bool {
+	return mountPoint == "/" || path == mountPoint || strings.HasPrefix(path, mountPoint+"/")
+}
+
+func hasOption(options, option string) bool {
+	for _, o := range strings.Split(options, ",") {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeMountInfo decodes the octal escapes of spaces, tabs, newlines and
+// backslashes in paths of the mountinfo.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/derfetzer/longhorn-monitor/healthcheck/apiclient"
+)
+
+const testMountInfo = `22 1 0:21 / / rw,relatime - overlay overlay rw,lowerdir=/l,upperdir=/u
+23 22 8:1 /pvc /pvc/data rw,relatime - ext4 /dev/longhorn/pvc-1 ro,errors=remount-ro
+24 22 8:2 /pvc /pvc/wal rw,relatime - ext4 /dev/longhorn/pvc-2 rw
+25 22 8:3 / /pvc/my\040logs ro,relatime master:3 - ext4 /dev/longhorn/pvc-3 rw
+26 22 8:4 / /pvc/cache rw,relatime - ext4 /dev/longhorn/pvc-4 rw
+27 26 8:5 / /pvc/cache ro,relatime - ext4 /dev/longhorn/pvc-5 rw
+`
+
+func TestIsReadOnlyMount(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"/pvc/data":       true,
+		"/pvc/data/probe": true,
+		"/pvc/wal":        false,
+		"/pvc/wal2":       false,
+		"/pvc/my logs":    true,
+		"/pvc/cache":      true,
+		"/tmp":            false,
+	} {
+		readOnly, found := isReadOnlyMount(strings.NewReader(testMountInfo), path)
+		if !found {
+			t.Errorf("expected mount of %s to be found", path)
+		}
+		if readOnly != expected {
+			t.Errorf("expected read-only of %s to be %v", path, expected)
+		}
+	}
+
+	if _, found := isReadOnlyMount(strings.NewReader(""), "/pvc"); found {
+		t.Error("expected no mount to be found")
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	for errno, expected := range map[syscall.Errno]apiclient.FailureReason{
+		syscall.EROFS:  reasonReadOnly,
+		syscall.ENOSPC: reasonDiskFull,
+		syscall.EDQUOT: reasonDiskFull,
+		syscall.EIO:    reasonIOError,
+		syscall.EACCES: reasonPermissionDenied,
+		syscall.EINVAL: reasonUnknown,
+	} {
+		err := fmt.Errorf("could not write probe file: %w", &os.PathError{Op: "write", Path: "/pvc/probe", Err: errno})
+		if reason := classifyError(err); reason != expected {
+			t.Errorf("expected reason %s for %v, got %s", expected, errno, reason)
+		}
+	}
+}
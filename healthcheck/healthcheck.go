@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -14,14 +19,50 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// HealthCheckConfig configures the health check. If TokenFile is set, the
+// token in it authenticates the reports. The TLS fields configure how the
+// monitor is verified and the client certificate presented to it. If
+// StatusPort is set, the result of the latest probes is served to the kubelet.
+// At most QueueSize reports are kept while the monitor is unreachable.
+// Latency thresholds of 0 disable the respective check, the latency
+// percentile is taken over the last LatencyWindow probes of a volume.
 type HealthCheckConfig struct {
 	Interval       uint32
+	Timeout        uint32
+	PostTimeout    uint32
 	MonitorService string
+	StatusPort     uint32
+	TokenFile      string
+
+	TLSCA       string
+	TLSCAFile   string
+	TLSCertFile string
+	TLSKeyFile  string
+
+	QueueSize      uint32
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+
+	LatencyWarn       time.Duration
+	LatencyFail       time.Duration
+	LatencyPercentile uint32
+	LatencyWindow     uint32
 }
 
 type PodInfo struct {
 	Name      string
 	Namespace string
+	UID       string
+	Volumes   []Volume
+}
+
+// Volume is a volume of the pod checked by the health check. Path is the
+// directory the volume is mounted at.
+type Volume struct {
+	Name    string
+	Path    string
+	latency *latencyWindow
+	prober  *prober
 }
 
 func initLogging() {
@@ -51,9 +92,45 @@ func initConfig() *HealthCheckConfig {
 		cfg.Interval = 60
 	}
 
+	cfg.Timeout = parseUintEnv("TIMEOUT", 2)
+	cfg.PostTimeout = parseUintEnv("POST_TIMEOUT", 5)
+	cfg.StatusPort = parseUintEnv("STATUS_PORT", 0)
+	cfg.TokenFile = os.Getenv("TOKEN_FILE")
+	cfg.TLSCA = os.Getenv("TLS_CA")
+	cfg.TLSCAFile = os.Getenv("TLS_CA_FILE")
+	cfg.TLSCertFile = os.Getenv("TLS_CERT_FILE")
+	cfg.TLSKeyFile = os.Getenv("TLS_KEY_FILE")
+	cfg.QueueSize = parseUintEnv("QUEUE_SIZE", 100)
+	if cfg.QueueSize == 0 {
+		log.Fatal().Msg("QUEUE_SIZE environment variable has to be greater than 0")
+	}
+	cfg.RetryBaseDelay = time.Duration(parseUintEnv("RETRY_BASE_DELAY", 1)) * time.Second
+	cfg.RetryMaxDelay = time.Duration(parseUintEnv("RETRY_MAX_DELAY", 30)) * time.Second
+	cfg.LatencyWarn = time.Duration(parseUintEnv("LATENCY_WARN_MS", 0)) * time.Millisecond
+	cfg.LatencyFail = time.Duration(parseUintEnv("LATENCY_FAIL_MS", 0)) * time.Millisecond
+	cfg.LatencyPercentile = parseUintEnv("LATENCY_PERCENTILE", 95)
+	if cfg.LatencyPercentile == 0 || cfg.LatencyPercentile > 100 {
+		log.Fatal().Msg("LATENCY_PERCENTILE environment variable has to be between 1 and 100")
+	}
+	cfg.LatencyWindow = parseUintEnv("LATENCY_WINDOW", 10)
+	if cfg.LatencyWindow == 0 {
+		log.Fatal().Msg("LATENCY_WINDOW environment variable has to be greater than 0")
+	}
+
 	return cfg
 }
 
+func parseUintEnv(name string, defaultValue uint32) uint32 {
+	if v, p := os.LookupEnv(name); p {
+		conv, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("%s environment variable could not be parsed", name)
+		}
+		return uint32(conv)
+	}
+	return defaultValue
+}
+
 func initPodInfo() *PodInfo {
 	podInfo := &PodInfo{}
 
@@ -69,64 +146,182 @@ func initPodInfo() *PodInfo {
 		log.Fatal().Msg("NAMSPACE environment variable has to be set")
 	}
 
+	if v, p := os.LookupEnv("POD_UID"); p {
+		podInfo.UID = v
+	}
+
+	// Each of several volumes is mounted at /pvc/<volume>, a single volume of
+	// older webhooks is mounted at /pvc.
+	if v, p := os.LookupEnv("VOLUME_NAMES"); p {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				podInfo.Volumes = append(podInfo.Volumes, Volume{Name: name, Path: filepath.Join("/pvc", name)})
+			}
+		}
+	}
+	if len(podInfo.Volumes) == 0 {
+		podInfo.Volumes = []Volume{{Name: os.Getenv("VOLUME_NAME"), Path: "/pvc"}}
+	}
+
 	return podInfo
 }
 
-func checkPvc(result chan<- bool) {
-	err := ioutil.WriteFile("/pvc/probe", []byte{0x42}, 0644)
+// bearerToken authenticates requests with the token in the file. The file is
+// read for each request, as the kubelet rotates projected tokens.
+func bearerToken(tokenFile string) apiclient.RequestEditorFn {
+	return func(ctx context.Context, req *http.Request) error {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return fmt.Errorf("could not read token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+		return nil
+	}
+}
+
+// probeResult is the outcome of a probe of a volume.
+type probeResult struct {
+	bytesWritten int
+	latency      time.Duration
+	err          error
+}
+
+func checkPvc(volume Volume, result chan<- probeResult) {
+	start := time.Now()
+	bytesWritten, err := probe(volume.Path)
 	if err != nil {
-		log.Error().Err(err).Msg("Could not write probe file")
+		log.Error().Err(err).Str("volume", volume.Name).Msg("Probe of volume failed")
+	}
+	result <- probeResult{bytesWritten: bytesWritten, latency: time.Since(start), err: err}
+}
+
+// checkVolume probes the volume and queues the report of its health.
+func checkVolume(reporter *reporter, status *status, config *HealthCheckConfig, podInfo *PodInfo, volume Volume) {
+	var reason apiclient.FailureReason
+	var body apiclient.PostHealthJSONRequestBody
+
+	timeout := time.Duration(config.Timeout) * time.Second
+	res, state := volume.prober.probe(timeout)
+	latencyMs := int64(res.latency / time.Millisecond)
+	body.LatencyMs = &latencyMs
+
+	switch state {
+	case probeDone:
+		bytesWritten := int64(res.bytesWritten)
+		body.BytesWritten = &bytesWritten
+		if res.err == nil {
+			volume.latency.add(res.latency)
+		} else {
+			reason = failureReason(volume.Path, res.err)
+			message := res.err.Error()
+			body.Message = &message
+		}
+	case probeTimedOut:
+		reason = reasonTimeout
+		message := fmt.Sprintf("probe did not finish within %s", timeout)
+		body.Message = &message
+		volume.latency.add(res.latency)
+		log.Error().Str("volume", volume.Name).Msg("Timeout while writing probe file")
+	case probeHung:
+		reason = reasonHungIO
+		message := fmt.Sprintf("probe has been blocked for %s", res.latency.Round(time.Second))
+		body.Message = &message
+		volume.latency.add(res.latency)
+		log.Error().Str("volume", volume.Name).Dur("blocked", res.latency).Msg("Probe of volume is still blocked")
 	}
-	result <- err == nil
+
+	if reason == "" {
+		var message string
+		if reason, message = checkLatency(config, volume.latency); message != "" {
+			body.Message = &message
+			log.Warn().Str("volume", volume.Name).Msg(message)
+		}
+	}
+
+	params := apiclient.PostHealthParams{
+		IsHealthy: reason == "",
+		PodName:   podInfo.Name,
+		Namespace: podInfo.Namespace,
+	}
+	if reason != "" {
+		body.Reason = &reason
+	}
+	if podInfo.UID != "" {
+		params.PodUid = &podInfo.UID
+	}
+	if volume.Name != "" {
+		params.VolumeName = &volume.Name
+	}
+
+	status.record(volume.Name, reason, time.Now())
+	reporter.enqueue(&report{volume: volume.Name, params: params, body: body})
 }
 
 func main() {
 	config := initConfig()
 	podInfo := initPodInfo()
+	for i := range podInfo.Volumes {
+		podInfo.Volumes[i].latency = newLatencyWindow(config.LatencyWindow)
+		podInfo.Volumes[i].prober = newProber(podInfo.Volumes[i])
+	}
+
+	httpClient, err := newHTTPClient(config)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not configure TLS")
+	}
+
+	clientOptions := []apiclient.ClientOption{apiclient.WithHTTPClient(httpClient)}
+	if config.TokenFile != "" {
+		clientOptions = append(clientOptions, apiclient.WithRequestEditorFn(bearerToken(config.TokenFile)))
+	}
 
-	client, err := apiclient.NewClient(config.MonitorService)
+	client, err := apiclient.NewClient(config.MonitorService, clientOptions...)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Could not create API client")
 	}
 
-	sigCh := make(chan os.Signal)
+	reporter := newReporter(postReport(client), config)
+	reporterCtx, stopReporter := context.WithCancel(context.Background())
+	go reporter.run(reporterCtx)
+
+	interval := time.Duration(config.Interval) * time.Second
+	status := newStatus(interval)
+	if config.StatusPort != 0 {
+		go serveStatus(config.StatusPort, status, podInfo.Volumes)
+	}
+
+	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 
-	ticker := time.NewTicker(time.Duration(config.Interval) * time.Second)
+	ticker := time.NewTicker(interval)
 	done := make(chan bool)
 
+	checkVolumes := func() {
+		// The volumes are probed independently so that a hanging
+		// volume does not delay the reports of the others.
+		var wg sync.WaitGroup
+		for _, volume := range podInfo.Volumes {
+			wg.Add(1)
+			go func(volume Volume) {
+				defer wg.Done()
+				checkVolume(reporter, status, config, podInfo, volume)
+			}(volume)
+		}
+		wg.Wait()
+	}
+
 	go func() {
+		// Probe right away, otherwise the pod would only become ready after
+		// the first interval.
+		if config.StatusPort != 0 {
+			checkVolumes()
+		}
 		for {
 			select {
 			case <-done:
 				return
 			case <-ticker.C:
-				result := make(chan bool, 1)
-				go checkPvc(result)
-
-				var isHealthy bool
-
-				select {
-				case res := <-result:
-					isHealthy = res
-				case <-time.After(2 * time.Second):
-					isHealthy = false
-					log.Error().Err(err).Msg("Timeout while writing probe file")
-				}
-
-				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-
-				_, err := client.PostHealth(ctx, &apiclient.PostHealthParams{
-					IsHealthy: isHealthy,
-					PodName:   podInfo.Name,
-					Namespace: podInfo.Namespace,
-				})
-
-				if err != nil {
-					log.Error().Err(err).Msg("Could not post health to monitor")
-				}
-
-				cancel()
+				checkVolumes()
 			}
 		}
 	}()
@@ -137,15 +332,18 @@ func main() {
 
 		ticker.Stop()
 		done <- true
+		stopReporter()
 
 		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 
-		_, err := client.DeleteHealth(ctx, &apiclient.DeleteHealthParams{
+		resp, err := client.DeleteHealth(ctx, &apiclient.DeleteHealthParams{
 			PodName:   podInfo.Name,
 			Namespace: podInfo.Namespace,
 		})
 
-		if err != nil {
+		if err == nil {
+			resp.Body.Close()
+		} else {
 			log.Error().Err(err).Msg("Could not delete health from monitor")
 		}
 
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/derfetzer/longhorn-monitor/healthcheck/apiclient"
+)
+
+// latencyWindow keeps the latencies of the last probes of a volume.
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+func newLatencyWindow(size uint32) *latencyWindow {
+	return &latencyWindow{samples: make([]time.Duration, size)}
+}
+
+func (w *latencyWindow) add(latency time.Duration) {
+	w.samples[w.next] = latency
+	w.next = (w.next + 1) % len(w.samples)
+	if w.next == 0 {
+		w.full = true
+	}
+}
+
+// percentile returns the nearest-rank percentile of the latencies. It is only
+// available once the window is full, so that single slow probes after the
+// start do not mark a volume as slow.
+func (w *latencyWindow) percentile(p uint32) (time.Duration, bool) {
+	if !w.full {
+		return 0, false
+	}
+
+	sorted := append([]time.Duration(nil), w.samples...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	rank := (int(p)*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1], true
+}
+
+// checkLatency compares the latency percentile of the volume with the
+// thresholds. Exceeding the fail threshold makes the volume unhealthy, while
+// exceeding the warn threshold only reports it as degraded in the message.
+func checkLatency(config *HealthCheckConfig, window *latencyWindow) (apiclient.FailureReason, string) {
+	latency, ok := window.percentile(config.LatencyPercentile)
+	if !ok {
+		return "", ""
+	}
+
+	if config.LatencyFail > 0 && latency >= config.LatencyFail {
+		return reasonSlowIO, fmt.Sprintf("p%d latency of the last %d probes is %s, exceeding %s",
+			config.LatencyPercentile, len(window.samples), latency, config.LatencyFail)
+	}
+	if config.LatencyWarn > 0 && latency >= config.LatencyWarn {
+		return "", fmt.Sprintf("degraded: p%d latency of the last %d probes is %s, exceeding %s",
+			config.LatencyPercentile, len(window.samples), latency, config.LatencyWarn)
+	}
+	return "", ""
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyWindow(t *testing.T) {
+	window := newLatencyWindow(4)
+	for _, latency := range []time.Duration{40, 10, 30} {
+		window.add(latency * time.Millisecond)
+	}
+	if _, ok := window.percentile(50); ok {
+		t.Error("expected no percentile before the window is full")
+	}
+
+	window.add(20 * time.Millisecond)
+	for p, expected := range map[uint32]time.Duration{1: 10, 50: 20, 75: 30, 95: 40, 100: 40} {
+		if latency, ok := window.percentile(p); !ok || latency != expected*time.Millisecond {
+			t.Errorf("expected p%d of %s, got %s", p, expected*time.Millisecond, latency)
+		}
+	}
+
+	// The oldest latency is replaced
+	window.add(5 * time.Millisecond)
+	if latency, _ := window.percentile(100); latency != 30*time.Millisecond {
+		t.Errorf("expected p100 of 30ms, got %s", latency)
+	}
+}
+
+func TestCheckLatency(t *testing.T) {
+	config := &HealthCheckConfig{
+		LatencyWarn:       100 * time.Millisecond,
+		LatencyFail:       time.Second,
+		LatencyPercentile: 50,
+	}
+	window := newLatencyWindow(2)
+
+	fill := func(latency time.Duration) {
+		window.add(latency)
+		window.add(latency)
+	}
+
+	fill(50 * time.Millisecond)
+	if reason, message := checkLatency(config, window); reason != "" || message != "" {
+		t.Errorf("expected healthy volume, got %q %q", reason, message)
+	}
+
+	fill(500 * time.Millisecond)
+	if reason, message := checkLatency(config, window); reason != "" || message == "" {
+		t.Errorf("expected degraded volume, got %q %q", reason, message)
+	}
+
+	fill(1900 * time.Millisecond)
+	if reason, _ := checkLatency(config, window); reason != reasonSlowIO {
+		t.Errorf("expected slow volume, got %q", reason)
+	}
+
+	// Thresholds of 0 are disabled
+	if reason, message := checkLatency(&HealthCheckConfig{LatencyPercentile: 50}, window); reason != "" || message != "" {
+		t.Errorf("expected disabled thresholds, got %q %q", reason, message)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+)
+
+// probeSize is the size of the probe payload. It is a multiple of the logical
+// block size of common devices so that it can be written with O_DIRECT.
+const probeSize = 4096
+
+const probeFile = "probe"
+
+// probe writes a random payload to the volume, syncs it to the device and
+// verifies that reading it back bypassing the page cache yields the same
+// checksum. It returns the number of bytes written.
+func probe(dir string) (int, error) {
+	payload, err := newPayload(time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("could not create payload: %w", err)
+	}
+	checksum := sha256.Sum256(payload)
+
+	path := filepath.Join(dir, probeFile)
+	if err := writeProbe(path, payload); err != nil {
+		return 0, err
+	}
+	if err := syncDir(dir); err != nil {
+		return len(payload), err
+	}
+
+	readBack, err := readProbe(path)
+	if err != nil {
+		return len(payload), err
+	}
+	if sha256.Sum256(readBack) != checksum {
+		return len(payload), fmt.Errorf("checksum of probe file %s does not match", path)
+	}
+	return len(payload), nil
+}
+
+// newPayload returns a block starting with the timestamp of the probe followed
+// by random bytes, so that each probe writes different data.
+func newPayload(now time.Time) ([]byte, error) {
+	payload := alignedBlock()
+	binary.BigEndian.PutUint64(payload, uint64(now.UnixNano()))
+	if _, err := io.ReadFull(rand.Reader, payload[8:]); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func writeProbe(path string, payload []byte) error {
+	f, err := openDirect(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("could not open probe file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(payload); err != nil {
+		return fmt.Errorf("could not write probe file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("could not sync probe file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not close probe file: %w", err)
+	}
+	return nil
+}
+
+func readProbe(path string) ([]byte, error) {
+	f, err := openDirect(path, os.O_RDONLY)
+	if err != nil {
+		return nil, fmt.Errorf("could not open probe file: %w", err)
+	}
+	defer f.Close()
+
+	readBack := alignedBlock()
+	if _, err := io.ReadFull(f, readBack); err != nil {
+		return nil, fmt.Errorf("could not read probe file: %w", err)
+	}
+	return readBack, nil
+}
+
+// syncDir persists the directory entry of the probe file.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("could not open volume directory: %w", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("could not sync volume directory: %w", err)
+	}
+	return nil
+}
+
+// openDirect opens the file bypassing the page cache. Filesystems not
+// supporting O_DIRECT fall back to buffered I/O, which is still synced.
+func openDirect(path string, flag int) (*os.File, error) {
+	if directFlag != 0 {
+		f, err := os.OpenFile(path, flag|directFlag, 0644)
+		if err == nil || !isDirectUnsupported(err) {
+			return f, err
+		}
+	}
+	return os.OpenFile(path, flag, 0644)
+}
+
+// alignedBlock returns a buffer of probeSize bytes aligned to probeSize, as
+// required for O_DIRECT.
+func alignedBlock() []byte {
+	buf := make([]byte, 2*probeSize)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & (probeSize - 1)); rem != 0 {
+		offset = probeSize - rem
+	}
+	return buf[offset : offset+probeSize : offset+probeSize]
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+const directFlag = syscall.O_DIRECT
+
+// isDirectUnsupported returns whether opening a file failed because the
+// filesystem does not support O_DIRECT, like tmpfs.
+func isDirectUnsupported(err error) bool {
+	return errors.Is(err, syscall.EINVAL)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+const directFlag = 0
+
+func isDirectUnsupported(err error) bool {
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "probe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bytesWritten, err := probe(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytesWritten != probeSize {
+		t.Errorf("expected %d bytes written, got %d", probeSize, bytesWritten)
+	}
+	first, err := ioutil.ReadFile(filepath.Join(dir, probeFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != probeSize {
+		t.Errorf("expected probe file of %d bytes, got %d", probeSize, len(first))
+	}
+
+	if _, err := probe(dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := ioutil.ReadFile(filepath.Join(dir, probeFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first) == string(second) {
+		t.Error("expected each probe to write a different payload")
+	}
+
+	if _, err := probe(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected error for missing volume")
+	}
+}
+
+func TestNewPayload(t *testing.T) {
+	now := time.Unix(1600000000, 42)
+	payload, err := newPayload(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payload) != probeSize {
+		t.Errorf("expected payload of %d bytes, got %d", probeSize, len(payload))
+	}
+	if written := time.Unix(0, int64(binary.BigEndian.Uint64(payload))); !written.Equal(now) {
+		t.Errorf("expected timestamp %v, got %v", now, written)
+	}
+}
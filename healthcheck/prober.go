@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+)
+
+type probeState int
+
+const (
+	// probeDone is a probe that finished within the timeout.
+	probeDone probeState = iota
+	// probeTimedOut is a probe that did not finish within the timeout.
+	probeTimedOut
+	// probeHung is a probe that did not finish since an earlier tick.
+	probeHung
+)
+
+// prober runs the probes of a volume with at most one probe in flight. A probe
+// blocked on a stuck device cannot be cancelled, so instead of starting
+// another one that would block as well, it is reported as hung until it
+// returns.
+type prober struct {
+	run     func(result chan<- probeResult)
+	pending chan probeResult
+	started time.Time
+}
+
+func newProber(volume Volume) *prober {
+	return &prober{
+		run: func(result chan<- probeResult) {
+			checkPvc(volume, result)
+		},
+	}
+}
+
+// probe starts a probe and waits for its result up to the timeout. The latency
+// of probes that did not finish is the time they have been running.
+func (p *prober) probe(timeout time.Duration) (probeResult, probeState) {
+	if p.pending != nil {
+		select {
+		case <-p.pending:
+			// The result of a probe finishing late is outdated.
+			p.pending = nil
+		default:
+			return probeResult{latency: time.Since(p.started)}, probeHung
+		}
+	}
+
+	p.pending = make(chan probeResult, 1)
+	p.started = time.Now()
+	go p.run(p.pending)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-p.pending:
+		p.pending = nil
+		return res, probeDone
+	case <-timer.C:
+		return probeResult{latency: time.Since(p.started)}, probeTimedOut
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProber(t *testing.T) {
+	unblock := make(chan struct{})
+	var started int32
+	p := &prober{
+		run: func(result chan<- probeResult) {
+			atomic.AddInt32(&started, 1)
+			<-unblock
+			result <- probeResult{err: errors.New("late")}
+		},
+	}
+
+	if _, state := p.probe(10 * time.Millisecond); state != probeTimedOut {
+		t.Errorf("expected timed out probe, got %v", state)
+	}
+
+	// No further probe is started while the first one is blocked
+	for i := 0; i < 3; i++ {
+		res, state := p.probe(10 * time.Millisecond)
+		if state != probeHung {
+			t.Errorf("expected hung probe, got %v", state)
+		}
+		if res.latency < 10*time.Millisecond {
+			t.Errorf("expected latency of the blocked probe, got %s", res.latency)
+		}
+	}
+	if started := atomic.LoadInt32(&started); started != 1 {
+		t.Errorf("expected 1 probe to be started, got %d", started)
+	}
+
+	// The late result is dropped and a new probe is started
+	close(unblock)
+	time.Sleep(10 * time.Millisecond)
+	p.run = func(result chan<- probeResult) {
+		result <- probeResult{bytesWritten: probeSize}
+	}
+	res, state := p.probe(time.Second)
+	if state != probeDone || res.err != nil || res.bytesWritten != probeSize {
+		t.Errorf("expected successful probe, got %v %v", state, res)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/derfetzer/longhorn-monitor/healthcheck/apiclient"
+	"github.com/rs/zerolog/log"
+)
+
+// report is a health report of a volume waiting to be sent to the monitor.
+type report struct {
+	volume string
+	params apiclient.PostHealthParams
+	body   apiclient.PostHealthJSONRequestBody
+}
+
+// reporter sends the reports to the monitor in order. Reports that could not
+// be sent are retried with jittered exponential backoff and the queued reports
+// are sent right away once the monitor is reachable again. Only the latest
+// report of each volume is sent then, as the monitor rejects reports of a
+// volume arriving faster than the interval. If more than maxQueued reports are
+// waiting, only the latest report of each volume is kept as well, and if that
+// is still too many, the oldest reports are dropped.
+type reporter struct {
+	send        func(ctx context.Context, r *report) error
+	maxQueued   int
+	sendTimeout time.Duration
+	retryBase   time.Duration
+	retryMax    time.Duration
+	queue       []*report
+	failures    int
+	notify      chan struct{}
+	lock        sync.Mutex
+}
+
+func newReporter(send func(ctx context.Context, r *report) error, config *HealthCheckConfig) *reporter {
+	return &reporter{
+		send:        send,
+		maxQueued:   int(config.QueueSize),
+		sendTimeout: time.Duration(config.PostTimeout) * time.Second,
+		retryBase:   config.RetryBaseDelay,
+		retryMax:    config.RetryMaxDelay,
+		notify:      make(chan struct{}, 1),
+	}
+}
+
+// enqueue adds the report to the queue without blocking.
+func (r *reporter) enqueue(rep *report) {
+	r.lock.Lock()
+	r.queue = append(r.queue, rep)
+	if len(r.queue) > r.maxQueued {
+		r.coalesce()
+	}
+	r.lock.Unlock()
+
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// coalesce shrinks the queue to at most maxQueued reports. The caller has to
+// hold the lock.
+func (r *reporter) coalesce() {
+	coalesced := latestReports(r.queue)
+	if len(coalesced) > r.maxQueued {
+		coalesced = coalesced[len(coalesced)-r.maxQueued:]
+	}
+
+	log.Warn().
+		Int("queued", len(r.queue)).
+		Int("kept", len(coalesced)).
+		Msg("Too many reports waiting for the monitor, coalesced them")
+	r.queue = coalesced
+}
+
+// latestReports returns the latest report of each volume in order.
+func latestReports(queue []*report) []*report {
+	latest := make(map[string]int)
+	for i, rep := range queue {
+		latest[rep.volume] = i
+	}
+
+	reports := make([]*report, 0, len(latest))
+	for i, rep := range queue {
+		if latest[rep.volume] == i {
+			reports = append(reports, rep)
+		}
+	}
+	return reports
+}
+
+func (r *reporter) queued() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return len(r.queue)
+}
+
+// run sends the queued reports until the context is done.
+func (r *reporter) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.notify:
+		}
+
+		for r.flush(ctx) {
+			timer := time.NewTimer(r.backoff())
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+// flush sends the queued reports in order and returns whether sending failed,
+// in which case the remaining reports are kept.
+func (r *reporter) flush(ctx context.Context) bool {
+	for {
+		r.lock.Lock()
+		if len(r.queue) == 0 {
+			r.lock.Unlock()
+			return false
+		}
+		// Reports piled up while the monitor was unreachable would be sent
+		// back-to-back, so all but the first of each volume would be rejected.
+		if r.failures > 0 {
+			r.queue = latestReports(r.queue)
+		}
+		rep := r.queue[0]
+		r.lock.Unlock()
+
+		sendCtx, cancel := context.WithTimeout(ctx, r.sendTimeout)
+		err := r.send(sendCtx, rep)
+		cancel()
+
+		r.lock.Lock()
+		if err != nil {
+			r.failures++
+			failures, queued := r.failures, len(r.queue)
+			r.lock.Unlock()
+
+			log.Error().
+				Err(err).
+				Str("volume", rep.volume).
+				Int("failures", failures).
+				Int("queued", queued).
+				Msg("Could not post health to monitor")
+			return true
+		}
+
+		if r.failures > 0 {
+			log.Info().
+				Int("queued", len(r.queue)-1).
+				Msg("Monitor is reachable again, sending queued reports")
+		}
+		r.failures = 0
+		// The queue may have been coalesced while sending.
+		if len(r.queue) > 0 && r.queue[0] == rep {
+			r.queue = r.queue[1:]
+		}
+		r.lock.Unlock()
+	}
+}
+
+// backoff returns the delay before the next attempt, doubling with each
+// failure up to retryMax and jittered by ±50% so that the sidecars of many pods
+// do not retry at the same time.
+func (r *reporter) backoff() time.Duration {
+	r.lock.Lock()
+	failures := r.failures
+	r.lock.Unlock()
+
+	delay := r.retryBase
+	for i := 1; i < failures && delay < r.retryMax; i++ {
+		delay *= 2
+	}
+	if delay > r.retryMax {
+		delay = r.retryMax
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)+1))
+}
+
+// postReport returns a function sending reports with the client. Only errors
+// that may be resolved by retrying are returned, reports rejected by the
+// monitor are dropped.
+func postReport(client *apiclient.Client) func(ctx context.Context, r *report) error {
+	return func(ctx context.Context, r *report) error {
+		resp, err := client.PostHealth(ctx, &r.params, r.body)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout:
+			return fmt.Errorf("monitor is unavailable: %s", resp.Status)
+		case resp.StatusCode == http.StatusTooManyRequests:
+			log.Warn().
+				Str("volume", r.volume).
+				Msg("Monitor rejected health report sent faster than the interval")
+		case resp.StatusCode >= 300:
+			log.Error().
+				Str("volume", r.volume).
+				Int("status", resp.StatusCode).
+				Msg("Monitor rejected health report")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/derfetzer/longhorn-monitor/healthcheck/apiclient"
+)
+
+// fakeMonitor records the reports it receives and fails while it is down.
+type fakeMonitor struct {
+	down     bool
+	attempts int
+	received []string
+	lock     sync.Mutex
+}
+
+func (m *fakeMonitor) send(ctx context.Context, r *report) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.attempts++
+	if m.down {
+		return errors.New("connection refused")
+	}
+	m.received = append(m.received, r.volume)
+	return nil
+}
+
+func (m *fakeMonitor) setDown(down bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.down = down
+}
+
+func (m *fakeMonitor) state() (int, []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.attempts, append([]string(nil), m.received...)
+}
+
+func TestReporter(t *testing.T) {
+	monitor := &fakeMonitor{down: true}
+	r := newReporter(monitor.send, &HealthCheckConfig{
+		QueueSize:      10,
+		PostTimeout:    1,
+		RetryBaseDelay: 5 * time.Millisecond,
+		RetryMaxDelay:  20 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.run(ctx)
+
+	for _, volume := range []string{"data", "wal", "data"} {
+		r.enqueue(&report{volume: volume})
+	}
+
+	// Failed reports are retried
+	waitFor(t, func() bool {
+		attempts, _ := monitor.state()
+		return attempts >= 3
+	})
+	if expected := []string{"wal", "data"}; !reflect.DeepEqual(expected, queuedVolumes(r)) {
+		t.Errorf("expected %v, got %v", expected, queuedVolumes(r))
+	}
+
+	// The latest report of each volume is sent once the monitor is back
+	monitor.setDown(false)
+	waitFor(t, func() bool {
+		return r.queued() == 0
+	})
+	_, received := monitor.state()
+	if expected := []string{"wal", "data"}; !reflect.DeepEqual(expected, received) {
+		t.Errorf("expected %v, got %v", expected, received)
+	}
+}
+
+func TestReporterRateLimited(t *testing.T) {
+	// The monitor is unavailable at first and then accepts one report per
+	// volume, like it does for reports arriving faster than the interval.
+	var (
+		down     = true
+		accepted = make(map[string]string)
+		lock     sync.Mutex
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		volume := req.URL.Query().Get("volumeName")
+		switch {
+		case down:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case accepted[volume] != "":
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			accepted[volume] = req.URL.Query().Get("isHealthy")
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	client, err := apiclient.NewClient(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r := newReporter(postReport(client), &HealthCheckConfig{
+		QueueSize:      10,
+		PostTimeout:    1,
+		RetryBaseDelay: 5 * time.Millisecond,
+		RetryMaxDelay:  20 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.run(ctx)
+
+	for _, isHealthy := range []bool{false, false, true} {
+		for _, volume := range []string{"data", "wal"} {
+			volumeName := volume
+			r.enqueue(&report{
+				volume: volume,
+				params: apiclient.PostHealthParams{IsHealthy: isHealthy, PodName: "db-0", Namespace: "default", VolumeName: &volumeName},
+			})
+		}
+	}
+	waitFor(t, func() bool {
+		return len(queuedVolumes(r)) == 2
+	})
+
+	lock.Lock()
+	down = false
+	lock.Unlock()
+	waitFor(t, func() bool {
+		return r.queued() == 0
+	})
+
+	// The latest reports are not rejected for following the older ones
+	lock.Lock()
+	defer lock.Unlock()
+	if expected := map[string]string{"data": "true", "wal": "true"}; !reflect.DeepEqual(expected, accepted) {
+		t.Errorf("expected %v, got %v", expected, accepted)
+	}
+}
+
+func TestReporterCoalesce(t *testing.T) {
+	r := newReporter(nil, &HealthCheckConfig{QueueSize: 3})
+
+	for _, volume := range []string{"data", "wal", "data", "wal"} {
+		r.enqueue(&report{volume: volume})
+	}
+	// Only the latest report of each volume is kept
+	if expected := []string{"data", "wal"}; !reflect.DeepEqual(expected, queuedVolumes(r)) {
+		t.Errorf("expected %v, got %v", expected, queuedVolumes(r))
+	}
+
+	for _, volume := range []string{"a", "b", "c"} {
+		r.enqueue(&report{volume: volume})
+	}
+	// The oldest reports are dropped if there are too many volumes
+	if expected := []string{"a", "b", "c"}; !reflect.DeepEqual(expected, queuedVolumes(r)) {
+		t.Errorf("expected %v, got %v", expected, queuedVolumes(r))
+	}
+}
+
+func TestReporterBackoff(t *testing.T) {
+	r := newReporter(nil, &HealthCheckConfig{
+		QueueSize:      1,
+		RetryBaseDelay: time.Second,
+		RetryMaxDelay:  8 * time.Second,
+	})
+
+	for failures, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 10: 8 * time.Second} {
+		r.failures = failures
+		for i := 0; i < 10; i++ {
+			if delay := r.backoff(); delay < expected/2 || delay > expected*3/2 {
+				t.Errorf("expected delay around %s after %d failures, got %s", expected, failures, delay)
+			}
+		}
+	}
+}
+
+func queuedVolumes(r *reporter) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var volumes []string
+	for _, rep := range r.queue {
+		volumes = append(volumes, rep.volume)
+	}
+	return volumes
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/derfetzer/longhorn-monitor/healthcheck/apiclient"
+	"github.com/rs/zerolog/log"
+)
+
+// status is the result of the latest probe of each volume, served to the
+// kubelet so that pods with failing volumes are taken out of service even if
+// the monitor is unreachable.
+type status struct {
+	interval  time.Duration
+	volumes   map[string]apiclient.FailureReason
+	lastProbe time.Time
+	lock      sync.RWMutex
+}
+
+func newStatus(interval time.Duration) *status {
+	return &status{
+		interval: interval,
+		volumes:  make(map[string]apiclient.FailureReason),
+	}
+}
+
+// record stores the result of a probe, an empty reason is a healthy volume.
+func (s *status) record(volume string, reason apiclient.FailureReason, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.volumes[volume] = reason
+	s.lastProbe = now
+}
+
+// isAlive returns whether the volumes are still probed. Probes are bounded by
+// their timeout, so a missing probe for several intervals means the health
+// check itself is stuck.
+func (s *status) isAlive(now time.Time) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.lastProbe.IsZero() || now.Sub(s.lastProbe) < 3*s.interval
+}
+
+// unhealthyVolumes returns the volumes whose latest probe failed with their
+// reasons, and whether all volumes have been probed.
+func (s *status) unhealthyVolumes(volumes []Volume) ([]string, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var unhealthy []string
+	probed := true
+	for _, volume := range volumes {
+		reason, p := s.volumes[volume.Name]
+		if !p {
+			probed = false
+		} else if reason != "" {
+			unhealthy = append(unhealthy, fmt.Sprintf("%s: %s", volume.Name, reason))
+		}
+	}
+	sort.Strings(unhealthy)
+	return unhealthy, probed
+}
+
+// serveStatus serves /livez and /readyz on the port.
+func serveStatus(port uint32, s *status, volumes []Volume) {
+	log.Info().Uint32("port", port).Msg("Serving liveness and readiness endpoints")
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), statusHandler(s, volumes)); err != nil {
+		log.Fatal().Err(err).Msg("Could not serve liveness and readiness endpoints")
+	}
+}
+
+// statusHandler handles /livez and /readyz. A pod is ready once all volumes
+// have been probed and their latest probes succeeded.
+func statusHandler(s *status, volumes []Volume) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		if !s.isAlive(time.Now()) {
+			http.Error(w, "volumes have not been probed for a while", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		unhealthy, probed := s.unhealthyVolumes(volumes)
+		if !probed {
+			http.Error(w, "volumes have not been probed yet", http.StatusServiceUnavailable)
+			return
+		}
+		if len(unhealthy) > 0 {
+			http.Error(w, "unhealthy volumes: "+strings.Join(unhealthy, ", "), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusHandler(t *testing.T) {
+	volumes := []Volume{{Name: "data"}, {Name: "wal"}}
+	s := newStatus(time.Minute)
+	handler := statusHandler(s, volumes)
+
+	get := func(path string) (int, string) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder.Code, recorder.Body.String()
+	}
+
+	// Not ready before all volumes were probed
+	if code, _ := get("/livez"); code != http.StatusOK {
+		t.Errorf("expected live before the first probe, got %d", code)
+	}
+	now := time.Now()
+	s.record("data", "", now)
+	if code, _ := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected not ready before all volumes were probed, got %d", code)
+	}
+
+	s.record("wal", "", now)
+	if code, _ := get("/readyz"); code != http.StatusOK {
+		t.Errorf("expected ready, got %d", code)
+	}
+
+	s.record("wal", reasonReadOnly, now)
+	code, body := get("/readyz")
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "wal: read-only") {
+		t.Errorf("expected not ready because of wal, got %d %q", code, body)
+	}
+
+	// Not live if the volumes have not been probed for a while
+	s.record("wal", "", now.Add(-5*time.Minute))
+	if code, _ := get("/livez"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected not live, got %d", code)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// newHTTPClient returns the client of the monitor API. The monitor is verified
+// against the CA bundle in TLSCA or TLSCAFile, or against the system CAs if
+// neither is set. If TLSCertFile and TLSKeyFile are set, the client
+// certificate in them is presented to the monitor. It is read for each
+// connection, so that rotated certificates are picked up.
+func newHTTPClient(config *HealthCheckConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	caBundle := []byte(config.TLSCA)
+	if config.TLSCAFile != "" {
+		var err error
+		caBundle, err = ioutil.ReadFile(config.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle: %w", err)
+		}
+	}
+	if len(caBundle) > 0 {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, errors.New("CA bundle contains no certificate")
+		}
+	}
+
+	if config.TLSCertFile != "" {
+		// Fail right away instead of on the first report.
+		if _, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile); err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not load client certificate: %w", err)
+			}
+			return &cert, nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
@@ -13,15 +13,82 @@ import (
 	"github.com/labstack/echo/v4"
 	"net/http"
 	"strings"
+	"time"
 )
 
+// FailureReason defines model for FailureReason.
+type FailureReason string
+
 // PodHealth defines model for PodHealth.
 type PodHealth struct {
-	ErrorCount int32  `json:"errorCount"`
-	IsDeleted  bool   `json:"isDeleted"`
-	IsHealthy  bool   `json:"isHealthy"`
-	Namespace  string `json:"namespace"`
-	PodName    string `json:"podName"`
+
+	// Number of attempts to restart the pod
+	DeleteAttempts *int32 `json:"deleteAttempts,omitempty"`
+	ErrorCount     int32  `json:"errorCount"`
+	IsDeleted      bool   `json:"isDeleted"`
+	IsHealthy      bool   `json:"isHealthy"`
+
+	// The pod has not reported its health for a while
+	IsStale bool `json:"isStale"`
+
+	// Error of the last failed attempt to restart the pod
+	LastDeleteError *string `json:"lastDeleteError,omitempty"`
+	Namespace       string  `json:"namespace"`
+
+	// Time of the next attempt to restart the pod
+	NextDeleteRetry *time.Time `json:"nextDeleteRetry,omitempty"`
+	PodName         string     `json:"podName"`
+
+	// The action taken to restart the pod
+	RemediationAction *string `json:"remediationAction,omitempty"`
+
+	// The last reports of the pod, oldest first
+	Reports *[]ProbeReport `json:"reports,omitempty"`
+
+	// Health of the named volumes of the pod
+	Volumes *[]VolumeHealth `json:"volumes,omitempty"`
+
+	// The pod would have been restarted if dry-run mode was disabled
+	WouldRestart bool `json:"wouldRestart"`
+}
+
+// ProbeReport defines model for ProbeReport.
+type ProbeReport struct {
+	BytesWritten *int64  `json:"bytesWritten,omitempty"`
+	IsHealthy    bool    `json:"isHealthy"`
+	LatencyMs    *int64  `json:"latencyMs,omitempty"`
+	Message      *string `json:"message,omitempty"`
+
+	// Why a volume is unhealthy. Volumes that are full are not remediated by restarting the pod.
+	Reason     *FailureReason `json:"reason,omitempty"`
+	Time       time.Time      `json:"time"`
+	VolumeName *string        `json:"volumeName,omitempty"`
+}
+
+// ProbeResult defines model for ProbeResult.
+type ProbeResult struct {
+
+	// Number of bytes written by the probe
+	BytesWritten *int64 `json:"bytesWritten,omitempty"`
+
+	// Duration of the probe in milliseconds
+	LatencyMs *int64 `json:"latencyMs,omitempty"`
+
+	// Error of the failed probe
+	Message *string `json:"message,omitempty"`
+
+	// Why a volume is unhealthy. Volumes that are full are not remediated by restarting the pod.
+	Reason *FailureReason `json:"reason,omitempty"`
+}
+
+// VolumeHealth defines model for VolumeHealth.
+type VolumeHealth struct {
+	ErrorCount int32 `json:"errorCount"`
+	IsHealthy  bool  `json:"isHealthy"`
+
+	// Why a volume is unhealthy. Volumes that are full are not remediated by restarting the pod.
+	Reason     *FailureReason `json:"reason,omitempty"`
+	VolumeName string         `json:"volumeName"`
 }
 
 // DeleteHealthParams defines parameters for DeleteHealth.
@@ -34,6 +101,9 @@ type DeleteHealthParams struct {
 	Namespace string `json:"namespace"`
 }
 
+// PostHealthJSONBody defines parameters for PostHealth.
+type PostHealthJSONBody ProbeResult
+
 // PostHealthParams defines parameters for PostHealth.
 type PostHealthParams struct {
 
@@ -45,8 +115,17 @@ type PostHealthParams struct {
 
 	// Namespace the pod is in
 	Namespace string `json:"namespace"`
+
+	// UID of the pod
+	PodUid *string `json:"podUid,omitempty"`
+
+	// Name of the checked volume
+	VolumeName *string `json:"volumeName,omitempty"`
 }
 
+// PostHealthRequestBody defines body for PostHealth for application/json ContentType.
+type PostHealthJSONRequestBody PostHealthJSONBody
+
 // ServerInterface represents all server handlers.
 type ServerInterface interface {
 	// Delete pod health entry
@@ -69,6 +148,8 @@ type ServerInterfaceWrapper struct {
 func (w *ServerInterfaceWrapper) DeleteHealth(ctx echo.Context) error {
 	var err error
 
+	ctx.Set("bearerAuth.Scopes", []string{""})
+
 	// Parameter object where we will unmarshal all parameters from the context
 	var params DeleteHealthParams
 	// ------------- Required query parameter "podName" -------------
@@ -103,6 +184,8 @@ func (w *ServerInterfaceWrapper) GetHealth(ctx echo.Context) error {
 func (w *ServerInterfaceWrapper) PostHealth(ctx echo.Context) error {
 	var err error
 
+	ctx.Set("bearerAuth.Scopes", []string{""})
+
 	// Parameter object where we will unmarshal all parameters from the context
 	var params PostHealthParams
 	// ------------- Required query parameter "isHealthy" -------------
@@ -126,6 +209,20 @@ func (w *ServerInterfaceWrapper) PostHealth(ctx echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid format for parameter namespace: %s", err))
 	}
 
+	// ------------- Optional query parameter "podUid" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "podUid", ctx.QueryParams(), &params.PodUid)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid format for parameter podUid: %s", err))
+	}
+
+	// ------------- Optional query parameter "volumeName" -------------
+
+	err = runtime.BindQueryParameter("form", true, false, "volumeName", ctx.QueryParams(), &params.VolumeName)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid format for parameter volumeName: %s", err))
+	}
+
 	// Invoke the callback with all the unmarshalled arguments
 	err = w.Handler.PostHealth(ctx, params)
 	return err
@@ -162,16 +259,28 @@ func RegisterHandlers(router EchoRouter, si ServerInterface) {
 // Base64 encoded, gzipped, json marshaled Swagger object
 var swaggerSpec = []string{
 
-	"H4sIAAAAAAAC/9xUTW/UQAz9K5HhGHbTj1MufEqlAkqFxKnqYZo4m2mT8dTjIIVq/zvyZElnaSpWHLll",
-	"Yo+f/d7zPEBFvSeHTgKUDxCqFnsTPy+p/oimk1YPnskji8UYQmbi9zQ40VND3BuBEqyTk2PIQUaP0xE3",
-	"yLDNwYYP2KFgrfm78A1Rh8ZN4QlpXA4702PwpsIkHISt22jUU31h+qXYNgfG+8Gy4l7NiWnBFDtP50p7",
-	"vp5HoptbrAS2Wtq6hhS0Iiemikxgb2wHJdzprzt5UyO/alB+Iq9q1F7FSqd1PpPbtMQu+0LOCjHk8AM5",
-	"WHJQQrE6WhWaTR6d8RZKOFkVqwJy8EbaqMDap+rUsVH9UpWMWHLnNZQwDbDL09tsehTkAOWV3goVWy8T",
-	"qlKTUZNJi5mnWgnQ3/cD8rijDMqEw0dmhQfMd85ZVGEJKtL/GyyzIbPuGchUrMNBrzU5eHJhsuxxUUxM",
-	"pY18/aQ0ny6F3pk6+4b3AwaZck6f5lyQZA0Nro5WC0PfGx5n2uNgbeQ+Qyc8ap0NylOZzlBmjZaaVofh",
-	"tGvG+85W8er6NmgXDwkJVrCPF18yNlDCi/Xjdq93q71+3Ovt7GvDbMbJ1vsjvs06G0R98cc0+hIcxN0e",
-	"M2coaaEgRoaQ1vMUFgi6pCCHufg8zJ6aMMbXz9gq3fu/2mp+jJbN/F/vzdG/782e9t99bfa3IpE/mm/7",
-	"KwAA//9yVwYGjgYAAA==",
+	"H4sIAAAAAAAC/9xXTXPbNhP+K5h93yMlOx/Tgy6tU7dppk3qcZrmkPqwIlYiIhBggKVdNqP/3gFAUpRJ",
+	"qZKnp95EYLEfz7Nf+gq5LStryLCHxVfIUesl5pvwsc1AK9P99HlBJUahH1Hp2tEtobcmHEjyuVMVq/AJ",
+	"H4tGoLi3ui5JKC9qUxBqLpq5+D0eesEFskBHYlVrHX8Yy8JRSVIhkxTLRjjyjI6VWQsuSFRWzv8wkAGZ",
+	"uoTFJ3CEcmaNbiADqfxmFnRBBsrOyDnrIANWJdmaIQOv7cNMWcigqM06/arIlcp7Zc1MklEkIYPabIx9",
+	"MHCXATcVwQI8O2XWsM3gxsqfYiAh5MrZihwr8gkATUxXzFRW7MeQvKvLJTlhVwJbGcG2i7ALDzJYWVci",
+	"wwKU4RfPoXdCGaY1ueBFjO17WxsOZk54oPx19E4G+fZ6aa0mNOk6BdUcun7PqGkc0m/JaVGgb8mrrAvU",
+	"KfYiES5W1gkUD4XSBNmEco2ek3M/RMZGRuJxgC1AFKTFCpUm2cE4jeKIOYMl+QpzGsQ4uKU/Wy9uiV0z",
+	"EaoqqXMiCB+33lMikWkWUnDKpcrKd1hOO9TVgbLmKk8+TKGP8U4wbshMu9KVCt2rnEOZxCiTjznN2s+p",
+	"XE9s+mnDkYhWosOlsjITVksKHCnngznFVEYV/3e0ggX872LXbC7afnJx4+ySbqMy2PaeoHPYhO/URiYc",
+	"SVnb04IlybbnDH061YvUmJLOKTcebK3lbQL4cC1EKVHgPYklkekYCUWxEtI1M1cbUVpJ4gG9kMrjUpOc",
+	"KI3IwJdaOZKBvy5Zhpk8rNy9rjCs+F39Pgphx7ldfqY8Qj9kYtThlg2T/+gUM5nHjeeblwcaz9HOopHJ",
+	"5M1bf6K6krzH9aGK6UbRMZL359Y2zYc960dLNmXXgap9xFirYwfBEcB9rU8A/NBAiXLiIQmGuRkzP2iG",
+	"7BRY92jYN3Jdu9iE+noKWoUyolRaK0+5NdJDdiZ5Rzp829w77/8dmrcTyO+V+wj6J4zYo5n+xOw8J98G",
+	"sgcbwzgFw1pHee0UN++DF23mETpyVzUXY7punA1PSYr35O5VTld5HpQLtmEKtTym2RA2t9gVFRfxGGup",
+	"yOT9LC2tUWxd3OoiChG3aH0Hc8FcwTa4qszKxh3VGsY8ckMlKg0L2ISjDX8nyc1WxH+Rm0tKFc46aPnF",
+	"mnVhnRFvk03I4J6cT0Fdzp/NL4O0rchgpWABL+aX80vIoEIuIigX1XD7ayfn4mt4korkjQwVE89bufDa",
+	"YUlMzsPi06iEsaRHkyocf6nJNW2nh8Wg9e/oZldTt5BPpsaUqTg1OmNhLVfmgMnhjDnd6F0Q9pU1PmXR",
+	"88vLcfr8+nOA+eXU1SuU4pa+1OQ5ybyc6HqWxcrWRu6lbsR2mLSf7oI3vi5LdE3PStpW09ZAhl2c62vi",
+	"MYuviXsKp2IKCUipOWBVaZXHpxef2yLfYXTaAtQn1mjvCFHuI3AltPIc0uZRNIr8adBuh8i8Jh4q8oxc",
+	"+6G+yvoJgG6s59OS/I3vU679E/jtgawbNq1/zLrBovQfL6uR0Q9vrk8K74OSe4ZWqP354XWm8oLyTb9h",
+	"H7C6N4TOsHyXpMnzKyubsyrshH8Wcb2aKKVrYlTa7y837Ucf5qMotqOG8OzpTe6cFvahksh0oFbbTjFQ",
+	"Ft6Su081ebf9ewDsXDTf5hEAAA==",
 }
 
 // GetSwagger returns the Swagger specification corresponding to the generated code
@@ -2,19 +2,156 @@ package apiserver
 
 import (
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
+	"k8s.io/client-go/util/workqueue"
 )
 
+// Reasons reported by health checks for unhealthy volumes.
+const (
+	ReasonReadOnly         FailureReason = "read-only"
+	ReasonDiskFull         FailureReason = "disk-full"
+	ReasonIOError          FailureReason = "io-error"
+	ReasonTimeout          FailureReason = "timeout"
+	ReasonSlowIO           FailureReason = "slow-io"
+	ReasonHungIO           FailureReason = "hung-io"
+	ReasonPermissionDenied FailureReason = "permission-denied"
+	ReasonUnknown          FailureReason = "unknown"
+)
+
+// DefaultReportHistory is the number of reports kept per pod unless configured
+// otherwise.
+const DefaultReportHistory = 10
+
+// Report is a health report of a volume received from the health check.
+type Report struct {
+	Time         time.Time
+	VolumeName   string
+	IsHealthy    bool
+	Reason       FailureReason
+	Message      string
+	Latency      time.Duration
+	BytesWritten int64
+}
+
+// HealthStatus is the health of a pod. The error count of a pod is the highest
+// error count of its volumes that can be remediated by restarting the pod, so
+// full volumes do not count.
 type HealthStatus struct {
+	UID             string
+	Volumes         map[string]*VolumeStatus
 	ErrorCount      uint32
 	LastSeen        time.Time
 	IsDeleted       bool
 	IsDeletePending bool
 	HasDeleteError  bool
+	IsStale         bool
+	WouldRestart    bool
+	Reports         []Report
+
+	RemediationAction string
+	DeleteAttempts    uint32
+	LastDeleteError   string
+	NextDeleteRetry   time.Time
+}
+
+// VolumeStatus is the health of a volume. Reason is the reason of the last
+// unhealthy report.
+type VolumeStatus struct {
+	ErrorCount uint32
+	Reason     FailureReason
+}
+
+// isRemediable returns whether restarting the pod may fix the volume.
+func (v *VolumeStatus) isRemediable() bool {
+	return v.Reason != ReasonDiskFull
+}
+
+// reportVolume records a report of the volume and returns the error count of
+// the volume before the report.
+func (s *HealthStatus) reportVolume(volumeName string, isHealthy bool, reason FailureReason) uint32 {
+	if s.Volumes == nil {
+		s.Volumes = make(map[string]*VolumeStatus)
+	}
+	volumeStatus, p := s.Volumes[volumeName]
+	if !p {
+		volumeStatus = &VolumeStatus{}
+		s.Volumes[volumeName] = volumeStatus
+	}
+
+	previousErrorCount := volumeStatus.ErrorCount
+	if isHealthy {
+		volumeStatus.ErrorCount = 0
+		volumeStatus.Reason = ""
+	} else {
+		volumeStatus.ErrorCount++
+		volumeStatus.Reason = reason
+	}
+
+	s.ErrorCount = 0
+	for _, v := range s.Volumes {
+		if v.isRemediable() && v.ErrorCount > s.ErrorCount {
+			s.ErrorCount = v.ErrorCount
+		}
+	}
+	return previousErrorCount
+}
+
+// addReport appends the report and drops the oldest reports exceeding the
+// limit.
+func (s *HealthStatus) addReport(report Report, limit int) {
+	s.Reports = append(s.Reports, report)
+	if len(s.Reports) > limit {
+		s.Reports = append([]Report(nil), s.Reports[len(s.Reports)-limit:]...)
+	}
+}
+
+// isHealthy returns whether all volumes of the pod are healthy.
+func (s *HealthStatus) isHealthy() bool {
+	for _, v := range s.Volumes {
+		if v.ErrorCount > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// unhealthiestVolume returns the name of the volume with the highest error
+// count that counts for the pod.
+func (s *HealthStatus) unhealthiestVolume() string {
+	var result string
+	var errorCount uint32
+	for volumeName, volumeStatus := range s.Volumes {
+		if !volumeStatus.isRemediable() {
+			continue
+		}
+		if volumeStatus.ErrorCount > errorCount || (volumeStatus.ErrorCount == errorCount && volumeName < result) {
+			result = volumeName
+			errorCount = volumeStatus.ErrorCount
+		}
+	}
+	return result
+}
+
+// copy returns a deep copy of the status.
+func (s *HealthStatus) copy() HealthStatus {
+	result := *s
+	if s.Volumes != nil {
+		result.Volumes = make(map[string]*VolumeStatus, len(s.Volumes))
+		for volumeName, volumeStatus := range s.Volumes {
+			v := *volumeStatus
+			result.Volumes[volumeName] = &v
+		}
+	}
+	if s.Reports != nil {
+		result.Reports = append([]Report(nil), s.Reports...)
+	}
+	return result
 }
 
 type PodIdentifier struct {
@@ -22,63 +159,321 @@ type PodIdentifier struct {
 	Namespace string
 }
 
+// PodDeleteResult is the outcome of an attempt to delete a pod. If the attempt
+// failed and will be retried, NextRetry is set.
 type PodDeleteResult struct {
 	Identifier PodIdentifier
 	Success    bool
+	Action     string
+	Error      string
+	NextRetry  time.Time
+}
+
+type HealthEventType string
+
+const (
+	// HealthEventHealthy is sent when a new pod reports healthy.
+	HealthEventHealthy HealthEventType = "Healthy"
+	// HealthEventRecovered is sent when the last unhealthy volume of a pod
+	// reports healthy again.
+	HealthEventRecovered HealthEventType = "Recovered"
+	// HealthEventUnhealthy is sent on the first unhealthy report of a volume.
+	HealthEventUnhealthy HealthEventType = "Unhealthy"
+	// HealthEventThresholdReached is sent when the deletion of a pod is queued.
+	HealthEventThresholdReached HealthEventType = "ThresholdReached"
+	// HealthEventWouldRestart is sent instead when the pod was not deleted
+	// because of dry-run mode.
+	HealthEventWouldRestart HealthEventType = "WouldRestart"
+	// HealthEventDeleted is sent when a pod was deleted.
+	HealthEventDeleted HealthEventType = "Deleted"
+	// HealthEventDeleteFailed is sent when an attempt to delete a pod failed.
+	HealthEventDeleteFailed HealthEventType = "DeleteFailed"
+)
+
+// HealthEvent describes a transition of the health of a pod. VolumeName and
+// ErrorCount are the ones of the volume that caused the transition, for a
+// recovery the error count before the volume recovered.
+type HealthEvent struct {
+	Type       HealthEventType
+	Identifier PodIdentifier
+	VolumeName string
+	ErrorCount uint32
+	Status     HealthStatus
 }
 
+// HealthListener is called while holding the lock of the shard of the pod and
+// therefore must not block.
+type HealthListener func(event HealthEvent)
+
+// HealthMonitor tracks the health of all pods. Pods reaching the error
+// threshold of their policy are added to the PodDeletes queue, whose worker
+// reports back via RecordDeleteResult. Adding to the queue never blocks, so
+// handlers do not wait for deletions. The last ReportHistory reports of each
+// pod are kept for debugging. Changes are saved to the Store in the background,
+// so that a slow store never blocks the handlers.
+//
+// The entries are spread over shards, each with its own lock, and the
+// responses are written after releasing it. Listeners and the PolicyResolver
+// are called while holding the lock of the shard of the pod.
 type HealthMonitor struct {
-	Pods           map[PodIdentifier]*HealthStatus
-	PodDeletes     chan<- PodIdentifier
-	ErrorThreshold uint32
-	Lock           sync.Mutex
+	PodDeletes    workqueue.Interface
+	Policies      PolicyResolver
+	Store         StateStore
+	ReportHistory int
+	shards        []*shard
+	listeners     []HealthListener
+	listenerLock  sync.RWMutex
+	saves         chan struct{}
+	saveLock      sync.Mutex
 }
 
-func NewHealthMonitor(podDeletes chan<- PodIdentifier, deleteResult <-chan PodDeleteResult, errorThreshold uint32) *HealthMonitor {
+// NewHealthMonitor returns a HealthMonitor without pod entries. Restore loads
+// the entries of the state store.
+func NewHealthMonitor(podDeletes workqueue.Interface, policies PolicyResolver, store StateStore) *HealthMonitor {
 	hm := &HealthMonitor{
-		Pods:           make(map[PodIdentifier]*HealthStatus),
-		PodDeletes:     podDeletes,
-		ErrorThreshold: errorThreshold,
+		PodDeletes:    podDeletes,
+		Policies:      policies,
+		Store:         store,
+		ReportHistory: DefaultReportHistory,
+		shards:        newShards(),
+		saves:         make(chan struct{}, 1),
 	}
-
 	go func() {
-		for {
-			delRes := <-deleteResult
-
-			hm.Lock.Lock()
-			if healthStatus, p := hm.Pods[delRes.Identifier]; p {
-				if delRes.Success {
-					healthStatus.HasDeleteError = false
-					healthStatus.IsDeletePending = false
-					healthStatus.IsDeleted = true
-				} else {
-					healthStatus.HasDeleteError = true
-					healthStatus.IsDeletePending = false
-					healthStatus.IsDeleted = false
-				}
-			}
-			hm.Lock.Unlock()
+		for range hm.saves {
+			hm.Flush()
 		}
 	}()
-
 	return hm
 }
 
-func (hm *HealthMonitor) PostHealth(ctx echo.Context, params PostHealthParams) error {
-	hm.Lock.Lock()
-	defer hm.Lock.Unlock()
+// Restore replaces the pod entries with the ones of the state store and queues
+// their pending deletions.
+func (hm *HealthMonitor) Restore() {
+	pods, err := hm.Store.Load()
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Could not load pod entries from state store")
+		return
+	}
 
+	hm.forEachShard(func(s *shard) {
+		s.pods = make(map[PodIdentifier]*HealthStatus)
+	})
+	for podIdentifier, healthStatus := range pods {
+		s := hm.shardOf(podIdentifier)
+		s.lock.Lock()
+		s.pods[podIdentifier] = healthStatus
+		s.lock.Unlock()
+		// Pending deletions are not persisted in the queue.
+		if healthStatus.IsDeletePending {
+			hm.PodDeletes.Add(podIdentifier)
+		}
+	}
+	log.Info().
+		Int("count", len(pods)).
+		Msg("Loaded pod entries from state store")
+}
+
+// RecordDryRun marks the entry of the pod as restarted in dry-run mode. The
+// pod is not queued again until it reports healthy.
+func (hm *HealthMonitor) RecordDryRun(podIdentifier PodIdentifier, action string) {
+	s := hm.shardOf(podIdentifier)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	healthStatus, p := s.pods[podIdentifier]
+	if !p {
+		return
+	}
+
+	healthStatus.RemediationAction = action
+	healthStatus.IsDeletePending = false
+	healthStatus.WouldRestart = true
+	hm.notify(HealthEventWouldRestart, podIdentifier, healthStatus)
+	hm.persist()
+}
+
+// CancelDelete drops the pending deletion of the pod, e.g. because its policy
+// does not restart pods anymore.
+func (hm *HealthMonitor) CancelDelete(podIdentifier PodIdentifier) {
+	s := hm.shardOf(podIdentifier)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	healthStatus, p := s.pods[podIdentifier]
+	if !p || !healthStatus.IsDeletePending {
+		return
+	}
+
+	healthStatus.IsDeletePending = false
+	hm.persist()
+}
+
+// IsDeletePending returns whether the pod still has to be deleted. The
+// deletion may have become obsolete while it was queued.
+func (hm *HealthMonitor) IsDeletePending(podIdentifier PodIdentifier) bool {
+	s := hm.shardOf(podIdentifier)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	healthStatus, p := s.pods[podIdentifier]
+	return p && healthStatus.IsDeletePending
+}
+
+// RecordDeleteResult updates the entry of the pod with the outcome of an
+// attempt to delete it.
+func (hm *HealthMonitor) RecordDeleteResult(result PodDeleteResult) {
+	s := hm.shardOf(result.Identifier)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	healthStatus, p := s.pods[result.Identifier]
+	if !p {
+		return
+	}
+
+	healthStatus.RemediationAction = result.Action
+	healthStatus.DeleteAttempts++
+	healthStatus.LastDeleteError = result.Error
+	healthStatus.NextDeleteRetry = result.NextRetry
+	if result.Success {
+		healthStatus.HasDeleteError = false
+		healthStatus.IsDeletePending = false
+		healthStatus.IsDeleted = true
+	} else {
+		healthStatus.HasDeleteError = true
+		healthStatus.IsDeletePending = !result.NextRetry.IsZero()
+		healthStatus.IsDeleted = false
+	}
+
+	if result.Success {
+		hm.notify(HealthEventDeleted, result.Identifier, healthStatus)
+	} else {
+		hm.notify(HealthEventDeleteFailed, result.Identifier, healthStatus)
+	}
+	hm.persist()
+}
+
+func (hm *HealthMonitor) AddListener(listener HealthListener) {
+	hm.listenerLock.Lock()
+	defer hm.listenerLock.Unlock()
+
+	hm.listeners = append(hm.listeners, listener)
+}
+
+// notify calls all listeners with the unhealthiest volume of the pod. The
+// caller has to hold the lock of the shard of the pod.
+func (hm *HealthMonitor) notify(eventType HealthEventType, podIdentifier PodIdentifier, healthStatus *HealthStatus) {
+	hm.notifyVolume(eventType, podIdentifier, healthStatus, healthStatus.unhealthiestVolume(), healthStatus.ErrorCount)
+}
+
+// notifyVolume calls all listeners. The caller has to hold the lock of the
+// shard of the pod.
+func (hm *HealthMonitor) notifyVolume(eventType HealthEventType, podIdentifier PodIdentifier, healthStatus *HealthStatus, volumeName string, errorCount uint32) {
+	hm.listenerLock.RLock()
+	defer hm.listenerLock.RUnlock()
+
+	for _, listener := range hm.listeners {
+		listener(HealthEvent{
+			Type:       eventType,
+			Identifier: podIdentifier,
+			VolumeName: volumeName,
+			ErrorCount: errorCount,
+			Status:     healthStatus.copy(),
+		})
+	}
+}
+
+// persist schedules saving the current state to the store. Changes made while
+// a save is in progress are coalesced into the next one.
+func (hm *HealthMonitor) persist() {
+	select {
+	case hm.saves <- struct{}{}:
+	default:
+	}
+}
+
+// Flush saves the current state to the store right away. The entries are
+// copied while holding the locks of their shards and saved after releasing
+// them.
+func (hm *HealthMonitor) Flush() {
+	// Saves are serialized so that an older state never overwrites a newer one.
+	hm.saveLock.Lock()
+	defer hm.saveLock.Unlock()
+
+	pods := make(map[PodIdentifier]*HealthStatus)
+	hm.forEachShard(func(s *shard) {
+		for podIdentifier, healthStatus := range s.pods {
+			copied := healthStatus.copy()
+			pods[podIdentifier] = &copied
+		}
+	})
+
+	if err := hm.Store.Save(pods); err != nil {
+		log.Error().
+			Err(err).
+			Msg("Could not save pod entries to state store")
+	}
+}
+
+func (hm *HealthMonitor) PostHealth(ctx echo.Context, params PostHealthParams) error {
 	podIdentifier := PodIdentifier{
 		Name:      params.PodName,
 		Namespace: params.Namespace,
 	}
 
+	// Health checks of older versions do not send a body.
+	var body PostHealthJSONBody
+	if err := ctx.Bind(&body); err != nil {
+		log.Warn().
+			Err(err).
+			Interface("podIdentifier", podIdentifier).
+			Msg("Could not parse probe result of pod")
+		return ctx.NoContent(http.StatusBadRequest)
+	}
+
+	return ctx.NoContent(hm.postHealth(podIdentifier, params, body))
+}
+
+// postHealth records the report of the pod and returns the status code of the
+// response.
+func (hm *HealthMonitor) postHealth(podIdentifier PodIdentifier, params PostHealthParams, body PostHealthJSONBody) int {
+	s := hm.shardOf(podIdentifier)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	log.Debug().
 		Interface("podIdentifier", podIdentifier).
 		Interface("params", params).
+		Interface("body", body).
 		Msg("Post health for pod")
 
-	if healthStatus, p := hm.Pods[podIdentifier]; p {
+	HealthReports.WithLabelValues(strconv.FormatBool(params.IsHealthy)).Inc()
+
+	if healthStatus, p := s.pods[podIdentifier]; p && params.PodUid != nil && isOtherPod(healthStatus, *params.PodUid) {
+		log.Info().
+			Interface("podIdentifier", podIdentifier).
+			Interface("params", params).
+			Interface("healthStatus", healthStatus).
+			Msg("Pod was recreated with a new UID")
+		delete(s.pods, podIdentifier)
+	}
+
+	var volumeName string
+	if params.VolumeName != nil {
+		volumeName = *params.VolumeName
+	}
+	report := newReport(volumeName, params.IsHealthy, body)
+	reason := report.Reason
+	if !params.IsHealthy {
+		VolumeFailures.WithLabelValues(string(reason)).Inc()
+	}
+
+	if healthStatus, p := s.pods[podIdentifier]; p {
+		if params.PodUid != nil {
+			healthStatus.UID = *params.PodUid
+		}
 		if healthStatus.IsDeleted || healthStatus.IsDeletePending {
 			log.Warn().
 				Interface("podIdentifier", podIdentifier).
@@ -86,27 +481,62 @@ func (hm *HealthMonitor) PostHealth(ctx echo.Context, params PostHealthParams) e
 				Interface("healthStatus", healthStatus).
 				Msg("Pod is already deleted or deletion is pending")
 
-			return ctx.NoContent(http.StatusInternalServerError)
+			return http.StatusInternalServerError
 		}
-		if params.IsHealthy {
-			healthStatus.ErrorCount = 0
+		wasUnhealthy := !healthStatus.isHealthy()
+		previousErrorCount := healthStatus.reportVolume(volumeName, params.IsHealthy, reason)
+		healthStatus.addReport(report, hm.ReportHistory)
+		if healthStatus.isHealthy() {
+			if wasUnhealthy {
+				hm.notifyVolume(HealthEventRecovered, podIdentifier, healthStatus, volumeName, previousErrorCount)
+			}
 			healthStatus.HasDeleteError = false
 			healthStatus.IsDeletePending = false
 			healthStatus.IsDeleted = false
-		} else {
-			healthStatus.ErrorCount++
+			healthStatus.DeleteAttempts = 0
+			healthStatus.LastDeleteError = ""
+			healthStatus.WouldRestart = false
+		} else if !params.IsHealthy && previousErrorCount == 0 {
+			if reason == ReasonDiskFull {
+				log.Warn().
+					Interface("podIdentifier", podIdentifier).
+					Str("volumeName", volumeName).
+					Msg("Volume of pod is full, restarting the pod will not help")
+			}
+			hm.notifyVolume(HealthEventUnhealthy, podIdentifier, healthStatus, volumeName, 1)
 		}
 		healthStatus.LastSeen = time.Now()
-		if healthStatus.ErrorCount >= hm.ErrorThreshold && !healthStatus.IsDeleted && !healthStatus.IsDeletePending {
+		if healthStatus.IsStale {
 			log.Info().
 				Interface("podIdentifier", podIdentifier).
-				Interface("params", params).
-				Interface("healthStatus", healthStatus).
-				Msg("Pod is unhealthy and will be deleted")
-			healthStatus.IsDeletePending = true
-			hm.PodDeletes <- podIdentifier
+				Msg("Stale pod reported again")
+			healthStatus.IsStale = false
+		}
+		if policy := hm.Policies(podIdentifier); healthStatus.ErrorCount >= policy.Threshold && !healthStatus.IsDeleted && !healthStatus.IsDeletePending && !healthStatus.WouldRestart {
+			if policy.Action == ActionNone {
+				log.Debug().
+					Interface("podIdentifier", podIdentifier).
+					Str("policy", policy.Name).
+					Msg("Pod is unhealthy, restarting it is disabled by policy")
+			} else {
+				log.Info().
+					Interface("podIdentifier", podIdentifier).
+					Interface("params", params).
+					Interface("healthStatus", healthStatus).
+					Str("policy", policy.Name).
+					Msg("Pod is unhealthy and will be deleted")
+				healthStatus.IsDeletePending = true
+				healthStatus.DeleteAttempts = 0
+				RestartsTriggered.WithLabelValues(podIdentifier.Namespace).Inc()
+				// In dry-run mode, the worker sends HealthEventWouldRestart.
+				if !policy.DryRun {
+					hm.notify(HealthEventThresholdReached, podIdentifier, healthStatus)
+				}
+				hm.PodDeletes.Add(podIdentifier)
+			}
 		}
-		return ctx.NoContent(http.StatusOK)
+		hm.persist()
+		return http.StatusOK
 	}
 
 	log.Info().
@@ -114,53 +544,345 @@ func (hm *HealthMonitor) PostHealth(ctx echo.Context, params PostHealthParams) e
 		Interface("params", params).
 		Msg("New pod registered")
 
+	healthStatus := &HealthStatus{ErrorCount: 0, LastSeen: time.Now()}
+	healthStatus.reportVolume(volumeName, params.IsHealthy, reason)
+	healthStatus.addReport(report, hm.ReportHistory)
+	if params.PodUid != nil {
+		healthStatus.UID = *params.PodUid
+	}
+	s.pods[podIdentifier] = healthStatus
 	if params.IsHealthy {
-		hm.Pods[podIdentifier] = &HealthStatus{ErrorCount: 0, LastSeen: time.Now()}
+		hm.notifyVolume(HealthEventHealthy, podIdentifier, healthStatus, volumeName, 0)
 	} else {
-		hm.Pods[podIdentifier] = &HealthStatus{ErrorCount: 1, LastSeen: time.Now()}
+		hm.notifyVolume(HealthEventUnhealthy, podIdentifier, healthStatus, volumeName, 1)
+	}
+	hm.persist()
+	return http.StatusCreated
+}
+
+// newReport returns the report of a volume from the probe result sent by the
+// health check. Unhealthy reports without reason have an unknown reason.
+func newReport(volumeName string, isHealthy bool, body PostHealthJSONBody) Report {
+	report := Report{
+		Time:       time.Now(),
+		VolumeName: volumeName,
+		IsHealthy:  isHealthy,
+	}
+	if !isHealthy {
+		report.Reason = ReasonUnknown
+		if body.Reason != nil {
+			report.Reason = *body.Reason
+		}
+	}
+	if body.Message != nil {
+		report.Message = *body.Message
+	}
+	if body.LatencyMs != nil {
+		report.Latency = time.Duration(*body.LatencyMs) * time.Millisecond
+	}
+	if body.BytesWritten != nil {
+		report.BytesWritten = *body.BytesWritten
 	}
-	return ctx.NoContent(http.StatusCreated)
+	return report
 }
 
 func (hm *HealthMonitor) GetHealth(ctx echo.Context) error {
-	hm.Lock.Lock()
-	defer hm.Lock.Unlock()
+	var result []PodHealth
+	hm.forEachShard(func(s *shard) {
+		result = append(result, podHealth(s)...)
+	})
+
+	return ctx.JSON(http.StatusOK, result)
+}
 
+// podHealth returns the health of the pods of the shard. The caller has to
+// hold the lock of the shard.
+func podHealth(s *shard) []PodHealth {
 	var result []PodHealth
 
-	for podIdentifier, healthStatus := range hm.Pods {
-		result = append(result, PodHealth{
-			PodName:    podIdentifier.Name,
-			Namespace:  podIdentifier.Namespace,
-			IsHealthy:  healthStatus.ErrorCount == 0,
-			ErrorCount: int32(healthStatus.ErrorCount),
-			IsDeleted:  healthStatus.IsDeleted})
+	for podIdentifier, healthStatus := range s.pods {
+		podHealth := PodHealth{
+			PodName:      podIdentifier.Name,
+			Namespace:    podIdentifier.Namespace,
+			IsHealthy:    healthStatus.isHealthy(),
+			ErrorCount:   int32(healthStatus.ErrorCount),
+			IsDeleted:    healthStatus.IsDeleted,
+			IsStale:      healthStatus.IsStale,
+			WouldRestart: healthStatus.WouldRestart}
+		if volumes := volumeHealth(healthStatus); len(volumes) > 0 {
+			podHealth.Volumes = &volumes
+		}
+		if len(healthStatus.Reports) > 0 {
+			reports := probeReports(healthStatus.Reports)
+			podHealth.Reports = &reports
+		}
+		if healthStatus.RemediationAction != "" {
+			action := healthStatus.RemediationAction
+			podHealth.RemediationAction = &action
+		}
+		if healthStatus.DeleteAttempts > 0 {
+			deleteAttempts := int32(healthStatus.DeleteAttempts)
+			podHealth.DeleteAttempts = &deleteAttempts
+		}
+		if healthStatus.LastDeleteError != "" {
+			lastDeleteError := healthStatus.LastDeleteError
+			podHealth.LastDeleteError = &lastDeleteError
+		}
+		if !healthStatus.NextDeleteRetry.IsZero() {
+			nextDeleteRetry := healthStatus.NextDeleteRetry
+			podHealth.NextDeleteRetry = &nextDeleteRetry
+		}
+		result = append(result, podHealth)
 	}
 
-	return ctx.JSON(http.StatusOK, result)
+	return result
 }
 
-func (hm *HealthMonitor) DeleteHealth(ctx echo.Context, params DeleteHealthParams) error {
-	hm.Lock.Lock()
-	defer hm.Lock.Unlock()
+// volumeHealth returns the health of the named volumes sorted by name. Reports
+// of health checks without volume name are only part of the pod health.
+func volumeHealth(healthStatus *HealthStatus) []VolumeHealth {
+	var result []VolumeHealth
+	for volumeName, volumeStatus := range healthStatus.Volumes {
+		if volumeName == "" {
+			continue
+		}
+		volume := VolumeHealth{
+			VolumeName: volumeName,
+			IsHealthy:  volumeStatus.ErrorCount == 0,
+			ErrorCount: int32(volumeStatus.ErrorCount),
+		}
+		if volumeStatus.Reason != "" {
+			reason := volumeStatus.Reason
+			volume.Reason = &reason
+		}
+		result = append(result, volume)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].VolumeName < result[j].VolumeName
+	})
+	return result
+}
+
+func probeReports(reports []Report) []ProbeReport {
+	result := make([]ProbeReport, 0, len(reports))
+	for _, report := range reports {
+		probeReport := ProbeReport{
+			Time:      report.Time,
+			IsHealthy: report.IsHealthy,
+		}
+		if report.VolumeName != "" {
+			volumeName := report.VolumeName
+			probeReport.VolumeName = &volumeName
+		}
+		if report.Reason != "" {
+			reason := report.Reason
+			probeReport.Reason = &reason
+		}
+		if report.Message != "" {
+			message := report.Message
+			probeReport.Message = &message
+		}
+		if report.Latency > 0 {
+			latencyMs := int64(report.Latency / time.Millisecond)
+			probeReport.LatencyMs = &latencyMs
+		}
+		if report.BytesWritten > 0 {
+			bytesWritten := report.BytesWritten
+			probeReport.BytesWritten = &bytesWritten
+		}
+		result = append(result, probeReport)
+	}
+	return result
+}
 
+func (hm *HealthMonitor) DeleteHealth(ctx echo.Context, params DeleteHealthParams) error {
 	podIdentifier := PodIdentifier{
 		Name:      params.PodName,
 		Namespace: params.Namespace,
 	}
 
-	if _, p := hm.Pods[podIdentifier]; p {
-		delete(hm.Pods, podIdentifier)
+	return ctx.NoContent(hm.deleteHealth(podIdentifier, params))
+}
+
+// deleteHealth removes the entry of the pod and returns the status code of the
+// response.
+func (hm *HealthMonitor) deleteHealth(podIdentifier PodIdentifier, params DeleteHealthParams) int {
+	s := hm.shardOf(podIdentifier)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, p := s.pods[podIdentifier]; p {
+		delete(s.pods, podIdentifier)
+		hm.persist()
 		log.Info().
 			Interface("podIdentifier", podIdentifier).
 			Interface("params", params).
 			Msg("Deleted pod entry")
-		return ctx.NoContent(http.StatusOK)
+		return http.StatusOK
 	}
 
 	log.Warn().
 		Interface("podIdentifier", podIdentifier).
 		Interface("params", params).
 		Msg("Pod entry not found for deletion")
-	return ctx.NoContent(http.StatusNotFound)
+	return http.StatusNotFound
+}
+
+// PodUpdated is called when a pod was created or updated in the cluster.
+// If the entry belongs to an earlier pod with the same name, e.g. of a
+// StatefulSet, it is removed.
+func (hm *HealthMonitor) PodUpdated(podIdentifier PodIdentifier, uid string) {
+	s := hm.shardOf(podIdentifier)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if updatePodUID(s, podIdentifier, uid) {
+		hm.persist()
+	}
+}
+
+// PodRemoved is called when a pod was removed from the cluster.
+func (hm *HealthMonitor) PodRemoved(podIdentifier PodIdentifier, uid string) {
+	s := hm.shardOf(podIdentifier)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if healthStatus, p := s.pods[podIdentifier]; p && (healthStatus.UID == "" || healthStatus.UID == uid) {
+		removePod(s, podIdentifier)
+		hm.persist()
+	}
+}
+
+// Reconcile updates all entries with the pods currently in the cluster.
+// lookupPod returns the UID of the pod and whether it exists. It is called
+// while holding the lock of the shard of the pod and must not block.
+func (hm *HealthMonitor) Reconcile(lookupPod func(PodIdentifier) (string, bool)) {
+	hm.forEachShard(func(s *shard) {
+		for podIdentifier := range s.pods {
+			if uid, exists := lookupPod(podIdentifier); exists {
+				updatePodUID(s, podIdentifier, uid)
+			} else {
+				removePod(s, podIdentifier)
+			}
+		}
+	})
+	hm.persist()
+}
+
+// isOtherPod returns whether a report with the UID belongs to another pod than
+// the entry. Entries without UID, e.g. restored from an older state or
+// registered by a health check without POD_UID, take the UID of the report,
+// unless their pod was deleted, as the report is then of the recreated pod.
+func isOtherPod(healthStatus *HealthStatus, uid string) bool {
+	if healthStatus.UID == "" {
+		return healthStatus.IsDeleted
+	}
+	return healthStatus.UID != uid
+}
+
+// updatePodUID updates the UID of the entry of the pod and returns whether it
+// changed. The caller has to hold the lock of the shard.
+func updatePodUID(s *shard, podIdentifier PodIdentifier, uid string) bool {
+	healthStatus, p := s.pods[podIdentifier]
+	if !p || healthStatus.UID == uid {
+		return false
+	}
+	if healthStatus.UID == "" {
+		healthStatus.UID = uid
+		return true
+	}
+
+	// The entry is registered again with the first report of the new pod.
+	log.Info().
+		Interface("podIdentifier", podIdentifier).
+		Str("uid", uid).
+		Interface("healthStatus", healthStatus).
+		Msg("Pod was recreated with a new UID")
+	delete(s.pods, podIdentifier)
+	return true
+}
+
+// removePod removes the entry of the pod. The caller has to hold the lock of
+// the shard.
+func removePod(s *shard, podIdentifier PodIdentifier) {
+	log.Info().
+		Interface("podIdentifier", podIdentifier).
+		Interface("healthStatus", s.pods[podIdentifier]).
+		Msg("Removed pod entry of pod that does not exist anymore")
+	delete(s.pods, podIdentifier)
+}
+
+// ReapStale marks all entries that have not been seen for staleFactor times
+// the interval of their pod as stale. If podExists is given, stale entries are
+// removed as soon as their pod does not exist anymore. Otherwise, or if the
+// lookup fails, they are removed once they have not been seen for expiryFactor
+// times the interval.
+func (hm *HealthMonitor) ReapStale(now time.Time, interval func(PodIdentifier) time.Duration, staleFactor uint32, expiryFactor uint32, podExists func(PodIdentifier) (bool, error)) {
+	var stale []PodIdentifier
+
+	hm.forEachShard(func(s *shard) {
+		for podIdentifier, healthStatus := range s.pods {
+			if now.Sub(healthStatus.LastSeen) < time.Duration(staleFactor)*interval(podIdentifier) {
+				continue
+			}
+			if !healthStatus.IsStale {
+				log.Warn().
+					Interface("podIdentifier", podIdentifier).
+					Interface("healthStatus", healthStatus).
+					Msg("Pod has not reported its health and is stale")
+				healthStatus.IsStale = true
+			}
+			stale = append(stale, podIdentifier)
+		}
+	})
+	hm.persist()
+
+	// Query the pods without holding the locks since it may take a while.
+	// Entries whose pod could not be checked are only removed after expireAfter.
+	isGone := make(map[PodIdentifier]bool)
+	for _, podIdentifier := range stale {
+		if podExists == nil {
+			continue
+		}
+		exists, err := podExists(podIdentifier)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Interface("podIdentifier", podIdentifier).
+				Msg("Could not check if stale pod still exists")
+			continue
+		}
+		isGone[podIdentifier] = !exists
+	}
+
+	for _, podIdentifier := range stale {
+		gone, checked := isGone[podIdentifier]
+		expireAfter := time.Duration(expiryFactor) * interval(podIdentifier)
+		hm.expire(podIdentifier, func(healthStatus *HealthStatus) bool {
+			if checked {
+				return gone
+			}
+			return now.Sub(healthStatus.LastSeen) >= expireAfter
+		})
+	}
+	hm.persist()
+}
+
+// expire removes the entry of the pod if it is still stale and isExpired
+// returns true for it.
+func (hm *HealthMonitor) expire(podIdentifier PodIdentifier, isExpired func(healthStatus *HealthStatus) bool) {
+	s := hm.shardOf(podIdentifier)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	healthStatus, p := s.pods[podIdentifier]
+	// The pod may have reported again in the meantime.
+	if !p || !healthStatus.IsStale || !isExpired(healthStatus) {
+		return
+	}
+	delete(s.pods, podIdentifier)
+	log.Info().
+		Interface("podIdentifier", podIdentifier).
+		Interface("healthStatus", healthStatus).
+		Msg("Removed expired pod entry")
 }
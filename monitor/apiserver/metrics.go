@@ -0,0 +1,140 @@
+package apiserver
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	HealthReports = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "longhorn_monitor_health_reports_total",
+		Help: "Number of health reports received from pods",
+	}, []string{"healthy"})
+
+	VolumeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "longhorn_monitor_volume_failures_total",
+		Help: "Number of unhealthy reports of volumes by reason",
+	}, []string{"reason"})
+
+	RestartsTriggered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "longhorn_monitor_restarts_triggered_total",
+		Help: "Number of pod restarts triggered because the error threshold was reached",
+	}, []string{"namespace"})
+
+	DeleteFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "longhorn_monitor_delete_failures_total",
+		Help: "Number of failed pod deletions",
+	}, []string{"namespace"})
+
+	DryRunRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "longhorn_monitor_dry_run_restarts_total",
+		Help: "Number of pod restarts skipped because of dry-run mode",
+	}, []string{"namespace"})
+
+	RateLimitedReports = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "longhorn_monitor_rate_limited_reports_total",
+		Help: "Number of health reports rejected by the global or the per-pod rate limit",
+	}, []string{"limit"})
+
+	UnauthenticatedReports = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "longhorn_monitor_unauthenticated_reports_total",
+		Help: "Number of health reports accepted without token while token authentication is optional",
+	}, []string{"namespace"})
+)
+
+var (
+	podLabels = []string{"namespace", "pod"}
+
+	errorCountDesc = prometheus.NewDesc(
+		"longhorn_monitor_pod_error_count",
+		"Number of consecutive unhealthy reports of the pod",
+		podLabels, nil)
+	isDeletedDesc = prometheus.NewDesc(
+		"longhorn_monitor_pod_deleted",
+		"Whether the pod was deleted by the monitor",
+		podLabels, nil)
+	isDeletePendingDesc = prometheus.NewDesc(
+		"longhorn_monitor_pod_delete_pending",
+		"Whether the deletion of the pod is pending",
+		podLabels, nil)
+	hasDeleteErrorDesc = prometheus.NewDesc(
+		"longhorn_monitor_pod_delete_error",
+		"Whether the deletion of the pod failed",
+		podLabels, nil)
+	isStaleDesc = prometheus.NewDesc(
+		"longhorn_monitor_pod_stale",
+		"Whether the pod has not reported its health for a while",
+		podLabels, nil)
+	wouldRestartDesc = prometheus.NewDesc(
+		"longhorn_monitor_pod_would_restart",
+		"Whether the pod would have been restarted if dry-run mode was disabled",
+		podLabels, nil)
+	volumeErrorCountDesc = prometheus.NewDesc(
+		"longhorn_monitor_volume_error_count",
+		"Number of consecutive unhealthy reports of the volume of the pod",
+		append(podLabels, "volume"), nil)
+	lastSeenDesc = prometheus.NewDesc(
+		"longhorn_monitor_pod_last_seen_seconds",
+		"Seconds since the last health report of the pod",
+		podLabels, nil)
+)
+
+type healthCollector struct {
+	hm *HealthMonitor
+}
+
+// NewHealthCollector returns a collector exporting the health status of all pods
+// known to the HealthMonitor.
+func NewHealthCollector(hm *HealthMonitor) prometheus.Collector {
+	return &healthCollector{hm: hm}
+}
+
+func (c *healthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- errorCountDesc
+	ch <- isDeletedDesc
+	ch <- isDeletePendingDesc
+	ch <- hasDeleteErrorDesc
+	ch <- isStaleDesc
+	ch <- wouldRestartDesc
+	ch <- volumeErrorCountDesc
+	ch <- lastSeenDesc
+}
+
+func (c *healthCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	c.hm.forEachShard(func(s *shard) {
+		collectPods(ch, s, now)
+	})
+}
+
+// collectPods sends the metrics of the pods of the shard. The caller has to
+// hold the lock of the shard.
+func collectPods(ch chan<- prometheus.Metric, s *shard, now time.Time) {
+	for podIdentifier, healthStatus := range s.pods {
+		labels := []string{podIdentifier.Namespace, podIdentifier.Name}
+
+		ch <- prometheus.MustNewConstMetric(errorCountDesc, prometheus.GaugeValue, float64(healthStatus.ErrorCount), labels...)
+		ch <- prometheus.MustNewConstMetric(isDeletedDesc, prometheus.GaugeValue, boolToFloat(healthStatus.IsDeleted), labels...)
+		ch <- prometheus.MustNewConstMetric(isDeletePendingDesc, prometheus.GaugeValue, boolToFloat(healthStatus.IsDeletePending), labels...)
+		ch <- prometheus.MustNewConstMetric(hasDeleteErrorDesc, prometheus.GaugeValue, boolToFloat(healthStatus.HasDeleteError), labels...)
+		ch <- prometheus.MustNewConstMetric(isStaleDesc, prometheus.GaugeValue, boolToFloat(healthStatus.IsStale), labels...)
+		ch <- prometheus.MustNewConstMetric(wouldRestartDesc, prometheus.GaugeValue, boolToFloat(healthStatus.WouldRestart), labels...)
+		ch <- prometheus.MustNewConstMetric(lastSeenDesc, prometheus.GaugeValue, now.Sub(healthStatus.LastSeen).Seconds(), labels...)
+
+		for volumeName, volumeStatus := range healthStatus.Volumes {
+			if volumeName == "" {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(volumeErrorCountDesc, prometheus.GaugeValue, float64(volumeStatus.ErrorCount), append(labels, volumeName)...)
+		}
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
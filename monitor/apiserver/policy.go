@@ -0,0 +1,29 @@
+package apiserver
+
+import "time"
+
+// ActionNone disables restarting pods.
+const ActionNone = "none"
+
+// Policy describes how unhealthy pods are remediated. Name is the name of the
+// LonghornMonitorPolicy it was resolved from, or empty for the global
+// configuration.
+type Policy struct {
+	Name                  string
+	Threshold             uint32
+	Cooldown              time.Duration
+	Action                string
+	MaxConcurrentRestarts uint32
+	DryRun                bool
+}
+
+// PolicyResolver returns the policy effective for the pod. It is called while
+// holding the lock of the shard of the pod and therefore must not block.
+type PolicyResolver func(podIdentifier PodIdentifier) Policy
+
+// StaticPolicy returns a resolver applying the same policy to all pods.
+func StaticPolicy(policy Policy) PolicyResolver {
+	return func(PodIdentifier) Policy {
+		return policy
+	}
+}
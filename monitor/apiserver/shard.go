@@ -0,0 +1,43 @@
+package apiserver
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// shardCount is the number of shards the entries of the pods are spread over.
+const shardCount = 32
+
+// shard holds the entries of a part of the pods. Operations on a pod only lock
+// its shard, so that the reports of different pods do not wait for each other.
+type shard struct {
+	pods map[PodIdentifier]*HealthStatus
+	lock sync.Mutex
+}
+
+func newShards() []*shard {
+	shards := make([]*shard, shardCount)
+	for i := range shards {
+		shards[i] = &shard{pods: make(map[PodIdentifier]*HealthStatus)}
+	}
+	return shards
+}
+
+// shardOf returns the shard holding the entry of the pod.
+func (hm *HealthMonitor) shardOf(podIdentifier PodIdentifier) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(podIdentifier.Namespace))
+	h.Write([]byte{0})
+	h.Write([]byte(podIdentifier.Name))
+	return hm.shards[h.Sum32()%shardCount]
+}
+
+// forEachShard calls f for each shard while holding its lock. The shards are
+// locked one after the other, so f never sees all entries at the same instant.
+func (hm *HealthMonitor) forEachShard(f func(s *shard)) {
+	for _, s := range hm.shards {
+		s.lock.Lock()
+		f(s)
+		s.lock.Unlock()
+	}
+}
@@ -0,0 +1,165 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const configMapStateKey = "state.json"
+
+// StateStore persists the health status entries of the HealthMonitor so that
+// a restart of the monitor does not reset the remediation progress.
+type StateStore interface {
+	Load() (map[PodIdentifier]*HealthStatus, error)
+	Save(pods map[PodIdentifier]*HealthStatus) error
+}
+
+// stateEntry is a persisted pod entry. The reports are left out, as their
+// history could exceed the size limit of a ConfigMap with many pods.
+type stateEntry struct {
+	PodIdentifier
+	HealthStatus
+}
+
+func encodeState(pods map[PodIdentifier]*HealthStatus) ([]byte, error) {
+	entries := make([]stateEntry, 0, len(pods))
+	for podIdentifier, healthStatus := range pods {
+		entry := stateEntry{PodIdentifier: podIdentifier, HealthStatus: *healthStatus}
+		entry.Reports = nil
+		entries = append(entries, entry)
+	}
+	return json.Marshal(entries)
+}
+
+func decodeState(data []byte) (map[PodIdentifier]*HealthStatus, error) {
+	var entries []stateEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	pods := make(map[PodIdentifier]*HealthStatus, len(entries))
+	for i := range entries {
+		pods[entries[i].PodIdentifier] = &entries[i].HealthStatus
+	}
+	return pods, nil
+}
+
+// MemoryStateStore does not persist anything.
+type MemoryStateStore struct{}
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{}
+}
+
+func (s *MemoryStateStore) Load() (map[PodIdentifier]*HealthStatus, error) {
+	return make(map[PodIdentifier]*HealthStatus), nil
+}
+
+func (s *MemoryStateStore) Save(pods map[PodIdentifier]*HealthStatus) error {
+	return nil
+}
+
+// FileStateStore persists the state as JSON in a local file, e.g. on a
+// persistent volume mounted into the monitor.
+type FileStateStore struct {
+	Path string
+}
+
+func NewFileStateStore(path string) *FileStateStore {
+	return &FileStateStore{Path: path}
+}
+
+func (s *FileStateStore) Load() (map[PodIdentifier]*HealthStatus, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return make(map[PodIdentifier]*HealthStatus), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeState(data)
+}
+
+func (s *FileStateStore) Save(pods map[PodIdentifier]*HealthStatus) error {
+	data, err := encodeState(pods)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a crash never leaves a
+	// truncated state file behind.
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// ConfigMapStateStore persists the state in a Kubernetes ConfigMap.
+type ConfigMapStateStore struct {
+	Client corev1.ConfigMapInterface
+	Name   string
+}
+
+func NewConfigMapStateStore(client corev1.ConfigMapInterface, name string) *ConfigMapStateStore {
+	return &ConfigMapStateStore{Client: client, Name: name}
+}
+
+func (s *ConfigMapStateStore) Load() (map[PodIdentifier]*HealthStatus, error) {
+	cm, err := s.Client.Get(s.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return make(map[PodIdentifier]*HealthStatus), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	data, p := cm.Data[configMapStateKey]
+	if !p {
+		return make(map[PodIdentifier]*HealthStatus), nil
+	}
+	return decodeState([]byte(data))
+}
+
+func (s *ConfigMapStateStore) Save(pods map[PodIdentifier]*HealthStatus) error {
+	data, err := encodeState(pods)
+	if err != nil {
+		return err
+	}
+
+	cm, err := s.Client.Get(s.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = s.Client.Create(&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: s.Name},
+			Data:       map[string]string{configMapStateKey: string(data)},
+		})
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	cm.Data[configMapStateKey] = string(data)
+	_, err = s.Client.Update(cm)
+	return err
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/derfetzer/longhorn-monitor/monitor/apiserver"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	podNameExtra = "authentication.kubernetes.io/pod-name"
+	podUIDExtra  = "authentication.kubernetes.io/pod-uid"
+
+	serviceAccountPrefix = "system:serviceaccount:"
+)
+
+// tokenIdentity is the pod a token was issued for.
+type tokenIdentity struct {
+	Namespace string
+	PodName   string
+	PodUID    string
+	expires   time.Time
+}
+
+// tokenAuth authenticates health reports with the projected ServiceAccount
+// tokens of the reporting pods. Tokens are validated with the TokenReview API
+// and the pod they are bound to has to be the reported pod. Reviews are cached
+// for cacheTTL, as each pod reports every interval. If Optional is set,
+// reports without a token are accepted, so that pods whose health check was
+// injected before token authentication keep being monitored.
+type tokenAuth struct {
+	Audience  string
+	Optional  bool
+	clientset kubernetes.Interface
+	cacheTTL  time.Duration
+	cache     map[string]tokenIdentity
+	lock      sync.Mutex
+}
+
+func newTokenAuth(clientset kubernetes.Interface, config *MonitorConfig) *tokenAuth {
+	return &tokenAuth{
+		Audience:  config.TokenAudience,
+		Optional:  config.TokenAuthOptional,
+		clientset: clientset,
+		cacheTTL:  time.Minute,
+		cache:     make(map[string]tokenIdentity),
+	}
+}
+
+// Middleware rejects reports and deletions of health entries that are not
+// authenticated by the token of the pod. Reading the entries is not
+// restricted.
+func (a *tokenAuth) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		if ctx.Request().Method == http.MethodGet {
+			return next(ctx)
+		}
+
+		authorization := ctx.Request().Header.Get(echo.HeaderAuthorization)
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			if a.Optional && ctx.Request().Method == http.MethodPost {
+				log.Warn().
+					Str("podName", ctx.QueryParam("podName")).
+					Str("namespace", ctx.QueryParam("namespace")).
+					Msg("Accepted report without token, the pod has to be recreated to send one")
+				apiserver.UnauthenticatedReports.WithLabelValues(ctx.QueryParam("namespace")).Inc()
+				return next(ctx)
+			}
+			return ctx.NoContent(http.StatusUnauthorized)
+		}
+
+		identity, err := a.review(strings.TrimPrefix(authorization, "Bearer "), time.Now())
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Could not review token")
+			return ctx.NoContent(http.StatusServiceUnavailable)
+		}
+		if identity == nil {
+			log.Warn().
+				Str("podName", ctx.QueryParam("podName")).
+				Str("namespace", ctx.QueryParam("namespace")).
+				Msg("Rejected request with invalid token")
+			return ctx.NoContent(http.StatusUnauthorized)
+		}
+
+		podUID := ctx.QueryParam("podUid")
+		if identity.PodName != ctx.QueryParam("podName") || identity.Namespace != ctx.QueryParam("namespace") ||
+			(podUID != "" && identity.PodUID != "" && identity.PodUID != podUID) {
+			log.Warn().
+				Str("podName", ctx.QueryParam("podName")).
+				Str("namespace", ctx.QueryParam("namespace")).
+				Str("tokenPodName", identity.PodName).
+				Str("tokenNamespace", identity.Namespace).
+				Msg("Rejected request for another pod than the one of the token")
+			return ctx.NoContent(http.StatusForbidden)
+		}
+
+		return next(ctx)
+	}
+}
+
+// review returns the pod the token was issued for, or nil if the token is not
+// valid for the audience of the monitor or not bound to a pod.
+func (a *tokenAuth) review(token string, now time.Time) (*tokenIdentity, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	a.lock.Lock()
+	if identity, p := a.cache[key]; p && now.Before(identity.expires) {
+		a.lock.Unlock()
+		return &identity, nil
+	}
+	a.lock.Unlock()
+
+	review, err := a.clientset.AuthenticationV1().TokenReviews().Create(&authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token:     token,
+			Audiences: []string{a.Audience},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create token review: %w", err)
+	}
+
+	identity := identityOf(review, a.Audience)
+	if identity == nil {
+		return nil, nil
+	}
+	identity.expires = now.Add(a.cacheTTL)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for k, v := range a.cache {
+		if !now.Before(v.expires) {
+			delete(a.cache, k)
+		}
+	}
+	a.cache[key] = *identity
+	return identity, nil
+}
+
+func identityOf(review *authenticationv1.TokenReview, audience string) *tokenIdentity {
+	status := review.Status
+	if !status.Authenticated || !containsString(status.Audiences, audience) {
+		return nil
+	}
+
+	// system:serviceaccount:<namespace>:<name>
+	parts := strings.Split(strings.TrimPrefix(status.User.Username, serviceAccountPrefix), ":")
+	if !strings.HasPrefix(status.User.Username, serviceAccountPrefix) || len(parts) != 2 {
+		return nil
+	}
+
+	podNames := status.User.Extra[podNameExtra]
+	if len(podNames) != 1 {
+		return nil
+	}
+	identity := &tokenIdentity{Namespace: parts[0], PodName: podNames[0]}
+	if podUIDs := status.User.Extra[podUIDExtra]; len(podUIDs) == 1 {
+		identity.PodUID = podUIDs[0]
+	}
+	return identity
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
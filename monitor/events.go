@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/derfetzer/longhorn-monitor/monitor/apiserver"
+	"github.com/rs/zerolog/log"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func initEventRecorder(clientset kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "longhorn-monitor"})
+}
+
+// watchEvents returns a channel receiving all health transitions that are
+// recorded as Kubernetes events.
+func watchEvents(healthMonitor *apiserver.HealthMonitor) <-chan apiserver.HealthEvent {
+	events := make(chan apiserver.HealthEvent, 100)
+
+	healthMonitor.AddListener(func(event apiserver.HealthEvent) {
+		if event.Type == apiserver.HealthEventHealthy {
+			return
+		}
+		select {
+		case events <- event:
+		default:
+			log.Warn().
+				Interface("podIdentifier", event.Identifier).
+				Str("type", string(event.Type)).
+				Msg("Dropped event of pod")
+		}
+	})
+
+	return events
+}
+
+// recordEvents records the health transitions as events of the pod and of the
+// workload owning it.
+func recordEvents(events <-chan apiserver.HealthEvent, clientset kubernetes.Interface, recorder record.EventRecorder) {
+	for event := range events {
+		eventType, reason, message := describeEvent(event)
+
+		recorder.Event(&v1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  event.Identifier.Namespace,
+			Name:       event.Identifier.Name,
+			UID:        types.UID(event.Status.UID),
+		}, eventType, reason, message)
+
+		pod, err := clientset.CoreV1().Pods(event.Identifier.Namespace).Get(event.Identifier.Name, metav1.GetOptions{})
+		if err != nil {
+			log.Debug().
+				Err(err).
+				Interface("podIdentifier", event.Identifier).
+				Msg("Could not get pod to record event for its owner")
+			continue
+		}
+
+		ownerRef, err := resolveOwnerRef(clientset, pod)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Interface("podIdentifier", event.Identifier).
+				Msg("Could not resolve owner of pod")
+		}
+		if ownerRef != nil {
+			recorder.Event(ownerRef, eventType, reason, message)
+		}
+	}
+}
+
+// describeEvent returns the type, reason and message of the Kubernetes event.
+func describeEvent(event apiserver.HealthEvent) (string, string, string) {
+	volumeName := event.VolumeName
+	if volumeName == "" {
+		volumeName = "<unknown>"
+	}
+	podName := event.Identifier.Name
+	errorCount := event.ErrorCount
+
+	switch event.Type {
+	case apiserver.HealthEventUnhealthy:
+		reason := apiserver.ReasonUnknown
+		if volumeStatus, p := event.Status.Volumes[event.VolumeName]; p && volumeStatus.Reason != "" {
+			reason = volumeStatus.Reason
+		}
+		return v1.EventTypeWarning, "VolumeUnhealthy",
+			fmt.Sprintf("Volume %s of pod %s is unhealthy (error count %d, reason %s)", volumeName, podName, errorCount, reason)
+	case apiserver.HealthEventThresholdReached:
+		return v1.EventTypeWarning, "RestartThresholdReached",
+			fmt.Sprintf("Volume %s of pod %s reached the error threshold (error count %d), pod will be restarted", volumeName, podName, errorCount)
+	case apiserver.HealthEventWouldRestart:
+		return v1.EventTypeNormal, "WouldRestart",
+			fmt.Sprintf("Volume %s of pod %s reached the error threshold (error count %d), pod would have been restarted with action %s (dry run)", volumeName, podName, errorCount, event.Status.RemediationAction)
+	case apiserver.HealthEventDeleted:
+		return v1.EventTypeNormal, "PodRestarted",
+			fmt.Sprintf("Pod %s was restarted with action %s because volume %s is unhealthy (error count %d)", podName, event.Status.RemediationAction, volumeName, errorCount)
+	case apiserver.HealthEventDeleteFailed:
+		return v1.EventTypeWarning, "PodRestartFailed",
+			fmt.Sprintf("Restarting pod %s with action %s failed because volume %s is unhealthy (error count %d): %s", podName, event.Status.RemediationAction, volumeName, errorCount, event.Status.LastDeleteError)
+	case apiserver.HealthEventRecovered:
+		return v1.EventTypeNormal, "VolumeRecovered",
+			fmt.Sprintf("Volume %s of pod %s recovered (error count %d)", volumeName, podName, errorCount)
+	}
+
+	return v1.EventTypeNormal, string(event.Type),
+		fmt.Sprintf("Volume %s of pod %s (error count %d)", volumeName, podName, errorCount)
+}
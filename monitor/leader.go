@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// proxiedHeader marks requests forwarded by a follower so that they are never
+// forwarded again while the leadership changes.
+const proxiedHeader = "X-Longhorn-Monitor-Proxied"
+
+// leaderProxy forwards the API requests received by a follower to the elected
+// leader, which is the only replica tracking the health of pods and deleting
+// them.
+type leaderProxy struct {
+	Identity       string
+	Namespace      string
+	Port           int
+	clientset      kubernetes.Interface
+	scheme         string
+	transport      http.RoundTripper
+	isLeader       bool
+	leaderIdentity string
+	leader         *url.URL
+	lock           sync.RWMutex
+}
+
+func newLeaderProxy(clientset kubernetes.Interface, config *MonitorConfig, port int) *leaderProxy {
+	return &leaderProxy{
+		Identity:  config.PodName,
+		Namespace: config.Namespace,
+		Port:      port,
+		clientset: clientset,
+		scheme:    "http",
+	}
+}
+
+// useTLS forwards requests to the leader over TLS.
+func (p *leaderProxy) useTLS(config *tls.Config) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	p.scheme = "https"
+	p.transport = transport
+}
+
+func (p *leaderProxy) startedLeading() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.isLeader = true
+	p.leader = nil
+}
+
+// newLeader forgets the address of the previous leader and resolves the one of
+// the new leader. If this replica is the new leader, requests are rejected
+// until it started leading.
+func (p *leaderProxy) newLeader(identity string) {
+	log.Info().
+		Str("leader", identity).
+		Msg("New leader elected")
+
+	p.lock.Lock()
+	p.leaderIdentity = identity
+	p.leader = nil
+	p.lock.Unlock()
+
+	if identity != p.Identity {
+		p.resolveLeader(identity)
+	}
+}
+
+// resolveLeader resolves the address of the leader from the IP of its pod, as
+// the identity of each replica is its pod name. It returns nil if the pod has
+// no IP yet or cannot be read.
+func (p *leaderProxy) resolveLeader(identity string) *url.URL {
+	pod, err := p.clientset.CoreV1().Pods(p.Namespace).Get(identity, metav1.GetOptions{})
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("leader", identity).
+			Msg("Could not get pod of leader")
+		return nil
+	}
+	if pod.Status.PodIP == "" {
+		log.Error().
+			Str("leader", identity).
+			Msg("Pod of leader has no IP")
+		return nil
+	}
+	leader := &url.URL{Scheme: p.scheme, Host: net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(p.Port))}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// The leadership may have changed in the meantime.
+	if p.leaderIdentity != identity {
+		return nil
+	}
+	p.leader = leader
+	return leader
+}
+
+// Middleware handles API requests locally on the leader and forwards them on
+// followers.
+func (p *leaderProxy) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		p.lock.RLock()
+		isLeader, leaderIdentity, leader := p.isLeader, p.leaderIdentity, p.leader
+		p.lock.RUnlock()
+
+		if isLeader {
+			return next(ctx)
+		}
+
+		// The address is resolved again if that failed once the leader was
+		// elected, e.g. as its pod had no IP yet.
+		if leader == nil && leaderIdentity != "" && leaderIdentity != p.Identity {
+			leader = p.resolveLeader(leaderIdentity)
+		}
+
+		if leader == nil || ctx.Request().Header.Get(proxiedHeader) != "" {
+			log.Warn().
+				Str("path", ctx.Request().URL.Path).
+				Msg("No leader available to handle request")
+			return ctx.NoContent(http.StatusServiceUnavailable)
+		}
+
+		ctx.Request().Header.Set(proxiedHeader, p.Identity)
+		reverseProxy := httputil.NewSingleHostReverseProxy(leader)
+		reverseProxy.Transport = p.transport
+		reverseProxy.ServeHTTP(ctx.Response(), ctx.Request())
+		return nil
+	}
+}
+
+// runLeaderElection competes for the lease of the monitor until the context is
+// done. Once this replica becomes the leader, it calls restore before handling
+// requests locally, so that no report is overwritten by the restored state,
+// and then calls run. A replica losing the leadership exits so that it never
+// deletes pods concurrently with the new leader.
+func runLeaderElection(ctx context.Context, clientset kubernetes.Interface, config *MonitorConfig, proxy *leaderProxy, restore func(), run func(ctx context.Context)) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      config.LeaseName,
+			Namespace: config.Namespace,
+		},
+		Client: clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: config.PodName,
+		},
+	}
+
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: 15 * time.Second,
+		RenewDeadline: 10 * time.Second,
+		RetryPeriod:   2 * time.Second,
+		Name:          config.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Info().
+					Str("identity", config.PodName).
+					Msg("Started leading")
+				restore()
+				proxy.startedLeading()
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Fatal().
+					Str("identity", config.PodName).
+					Msg("Lost leadership")
+			},
+			OnNewLeader: proxy.newLeader,
+		},
+	})
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/deepmap/oapi-codegen/pkg/middleware"
 	"github.com/derfetzer/longhorn-monitor/monitor/apiserver"
+	"github.com/getkin/kin-openapi/openapi3filter"
 
 	gommonlog "github.com/labstack/gommon/log"
 	"github.com/rs/zerolog"
@@ -15,16 +19,60 @@ import (
 	"github.com/ziflex/lecho/v2"
 
 	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	v1 "k8s.io/api/core/v1"
 )
 
 type MonitorConfig struct {
 	RestartThreshold uint32
 	Debug            bool
+	StateStore       string
+	StateFile        string
+	StateConfigMap   string
+	Namespace        string
+	Interval         uint32
+	StaleFactor      uint32
+	ExpiryFactor     uint32
+	StaleCheckPods   bool
+	WatchPods        bool
+	WatchPolicies    bool
+	MaxRestarts      uint32
+	RestartTimeout   uint32
+	ReportHistory    uint32
+
+	RemediationAction    string
+	NamespaceActions     map[string]string
+	GracePeriod          *int64
+	EvictionFallback     bool
+	DeleteMaxAttempts    uint32
+	DeleteRetryBaseDelay time.Duration
+	DeleteRetryMaxDelay  time.Duration
+	DryRun               bool
+	DryRunNamespaces     map[string]bool
+
+	LeaderElect bool
+	LeaseName   string
+	PodName     string
+
+	TokenAuth         bool
+	TokenAuthOptional bool
+	TokenAudience     string
+
+	RateLimit      uint32
+	RateLimitBurst uint32
+	PodRateLimit   bool
 }
 
 func initConfig() *MonitorConfig {
@@ -44,9 +92,182 @@ func initConfig() *MonitorConfig {
 		cfg.Debug = false
 	}
 
+	if v, p := os.LookupEnv("STATE_STORE"); p {
+		cfg.StateStore = v
+	} else {
+		cfg.StateStore = "memory"
+	}
+
+	if v, p := os.LookupEnv("STATE_FILE"); p {
+		cfg.StateFile = v
+	} else {
+		cfg.StateFile = "/var/lib/longhorn-monitor/state.json"
+	}
+
+	if v, p := os.LookupEnv("STATE_CONFIGMAP"); p {
+		cfg.StateConfigMap = v
+	} else {
+		cfg.StateConfigMap = "longhorn-monitor-state"
+	}
+
+	if v, p := os.LookupEnv("POD_NAMESPACE"); p {
+		cfg.Namespace = v
+	} else {
+		cfg.Namespace = "longhorn-addon"
+	}
+
+	cfg.Interval = parseUintEnv("HEALTHCHECK_INTERVAL", 60)
+	cfg.StaleFactor = parseUintEnv("STALE_FACTOR", 3)
+	cfg.ExpiryFactor = parseUintEnv("EXPIRY_FACTOR", 10)
+	cfg.MaxRestarts = parseUintEnv("MAX_CONCURRENT_RESTARTS", 1)
+	cfg.RestartTimeout = parseUintEnv("RESTART_BUDGET_TIMEOUT", 600)
+	cfg.ReportHistory = parseUintEnv("REPORT_HISTORY", apiserver.DefaultReportHistory)
+
+	if v, p := os.LookupEnv("REMEDIATION_ACTION"); p {
+		cfg.RemediationAction = v
+	} else {
+		cfg.RemediationAction = actionEvict
+	}
+	if !isValidAction(cfg.RemediationAction) {
+		log.Fatal().Msg("REMEDIATION_ACTION environment variable has to be one of evict, delete or force-delete")
+	}
+
+	// Format: namespace=action,namespace=action
+	cfg.NamespaceActions = make(map[string]string)
+	for _, entry := range strings.Split(os.Getenv("NAMESPACE_ACTIONS"), ",") {
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !isValidAction(parts[1]) {
+			log.Fatal().Str("entry", entry).Msg("NAMESPACE_ACTIONS environment variable could not be parsed")
+		}
+		cfg.NamespaceActions[parts[0]] = parts[1]
+	}
+
+	if v, p := os.LookupEnv("DELETE_GRACE_PERIOD"); p {
+		gracePeriod, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Fatal().Err(err).Msg("DELETE_GRACE_PERIOD environment variable could not be parsed")
+		}
+		cfg.GracePeriod = &gracePeriod
+	}
+
+	cfg.DeleteMaxAttempts = parseUintEnv("DELETE_MAX_ATTEMPTS", 5)
+	cfg.DeleteRetryBaseDelay = time.Duration(parseUintEnv("DELETE_RETRY_BASE_DELAY", 5)) * time.Second
+	cfg.DeleteRetryMaxDelay = time.Duration(parseUintEnv("DELETE_RETRY_MAX_DELAY", 300)) * time.Second
+
+	dryRun := os.Getenv("DRY_RUN")
+	if v, err := strconv.ParseBool(dryRun); err == nil {
+		cfg.DryRun = v
+	} else {
+		cfg.DryRun = false
+	}
+
+	// Format: namespace,namespace
+	cfg.DryRunNamespaces = make(map[string]bool)
+	for _, namespace := range strings.Split(os.Getenv("DRY_RUN_NAMESPACES"), ",") {
+		if namespace != "" {
+			cfg.DryRunNamespaces[namespace] = true
+		}
+	}
+
+	evictionFallback := os.Getenv("EVICTION_FALLBACK")
+	if v, err := strconv.ParseBool(evictionFallback); err == nil {
+		cfg.EvictionFallback = v
+	} else {
+		cfg.EvictionFallback = false
+	}
+
+	staleCheckPods := os.Getenv("STALE_CHECK_PODS")
+	if v, err := strconv.ParseBool(staleCheckPods); err == nil {
+		cfg.StaleCheckPods = v
+	} else {
+		cfg.StaleCheckPods = true
+	}
+
+	leaderElect := os.Getenv("LEADER_ELECT")
+	if v, err := strconv.ParseBool(leaderElect); err == nil {
+		cfg.LeaderElect = v
+	} else {
+		cfg.LeaderElect = false
+	}
+
+	if v, p := os.LookupEnv("LEASE_NAME"); p {
+		cfg.LeaseName = v
+	} else {
+		cfg.LeaseName = "longhorn-monitor"
+	}
+
+	if v, p := os.LookupEnv("POD_NAME"); p {
+		cfg.PodName = v
+	} else if hostname, err := os.Hostname(); err == nil {
+		cfg.PodName = hostname
+	} else {
+		log.Fatal().Err(err).Msg("POD_NAME environment variable is not set and hostname could not be determined")
+	}
+
+	watchPolicies := os.Getenv("WATCH_POLICIES")
+	if v, err := strconv.ParseBool(watchPolicies); err == nil {
+		cfg.WatchPolicies = v
+	} else {
+		cfg.WatchPolicies = true
+	}
+
+	tokenAuth := os.Getenv("TOKEN_AUTH")
+	if v, err := strconv.ParseBool(tokenAuth); err == nil {
+		cfg.TokenAuth = v
+	} else {
+		cfg.TokenAuth = true
+	}
+
+	// Health checks injected before token authentication send no token until
+	// their pods are recreated, so reports without one are accepted unless
+	// this is disabled.
+	tokenAuthOptional := os.Getenv("TOKEN_AUTH_OPTIONAL")
+	if v, err := strconv.ParseBool(tokenAuthOptional); err == nil {
+		cfg.TokenAuthOptional = v
+	} else {
+		cfg.TokenAuthOptional = true
+	}
+
+	if v, p := os.LookupEnv("TOKEN_AUDIENCE"); p {
+		cfg.TokenAudience = v
+	} else {
+		cfg.TokenAudience = "longhorn-monitor"
+	}
+
+	cfg.RateLimit = parseUintEnv("RATE_LIMIT", 100)
+	cfg.RateLimitBurst = parseUintEnv("RATE_LIMIT_BURST", 200)
+
+	podRateLimit := os.Getenv("POD_RATE_LIMIT")
+	if v, err := strconv.ParseBool(podRateLimit); err == nil {
+		cfg.PodRateLimit = v
+	} else {
+		cfg.PodRateLimit = true
+	}
+
+	watchPods := os.Getenv("WATCH_PODS")
+	if v, err := strconv.ParseBool(watchPods); err == nil {
+		cfg.WatchPods = v
+	} else {
+		cfg.WatchPods = true
+	}
+
 	return cfg
 }
 
+func parseUintEnv(name string, defaultValue uint32) uint32 {
+	if v, p := os.LookupEnv(name); p {
+		conv, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("%s environment variable could not be parsed", name)
+		}
+		return uint32(conv)
+	}
+	return defaultValue
+}
+
 func initLogging(config *MonitorConfig) {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnixMs
 
@@ -58,7 +279,7 @@ func initLogging(config *MonitorConfig) {
 	}
 }
 
-func initKubernetes() kubernetes.Interface {
+func initKubernetes() (kubernetes.Interface, dynamic.Interface) {
 	// creates the in-cluster config
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -69,11 +290,85 @@ func initKubernetes() kubernetes.Interface {
 	if err != nil {
 		log.Fatal().Err(err).Msg("Could not create clientset")
 	}
+	// creates the client for custom resources
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not create dynamic client")
+	}
 
-	return clientset
+	return clientset, dynamicClient
 }
 
-func initWebServer(healthMonitor *apiserver.HealthMonitor) *echo.Echo {
+func podIdentifierOf(pod *v1.Pod) apiserver.PodIdentifier {
+	return apiserver.PodIdentifier{Name: pod.Name, Namespace: pod.Namespace}
+}
+
+// initPodInformer keeps the entries of the health monitor in sync with the
+// lifecycle of the pods in the cluster.
+func initPodInformer(clientset kubernetes.Interface, healthMonitor *apiserver.HealthMonitor, stopCh <-chan struct{}) corelisters.PodLister {
+	factory := informers.NewSharedInformerFactory(clientset, 10*time.Minute)
+	podInformer := factory.Core().V1().Pods()
+
+	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			pod := obj.(*v1.Pod)
+			healthMonitor.PodUpdated(podIdentifierOf(pod), string(pod.UID))
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			pod := newObj.(*v1.Pod)
+			healthMonitor.PodUpdated(podIdentifierOf(pod), string(pod.UID))
+		},
+		DeleteFunc: func(obj interface{}) {
+			pod, ok := obj.(*v1.Pod)
+			if !ok {
+				tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+				if !ok {
+					return
+				}
+				if pod, ok = tombstone.Obj.(*v1.Pod); !ok {
+					return
+				}
+			}
+			healthMonitor.PodRemoved(podIdentifierOf(pod), string(pod.UID))
+		},
+	})
+
+	factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, podInformer.Informer().HasSynced) {
+		log.Fatal().Msg("Could not sync pod informer")
+	}
+
+	lister := podInformer.Lister()
+
+	// Entries loaded from the state store may belong to pods that are gone.
+	healthMonitor.Reconcile(func(podIdentifier apiserver.PodIdentifier) (string, bool) {
+		pod, err := lister.Pods(podIdentifier.Namespace).Get(podIdentifier.Name)
+		if err != nil {
+			return "", false
+		}
+		return string(pod.UID), true
+	})
+
+	return lister
+}
+
+func initStateStore(config *MonitorConfig, clientset kubernetes.Interface) apiserver.StateStore {
+	switch config.StateStore {
+	case "memory":
+		return apiserver.NewMemoryStateStore()
+	case "file":
+		return apiserver.NewFileStateStore(config.StateFile)
+	case "configmap":
+		return apiserver.NewConfigMapStateStore(clientset.CoreV1().ConfigMaps(config.Namespace), config.StateConfigMap)
+	}
+
+	log.Fatal().
+		Str("stateStore", config.StateStore).
+		Msg("STATE_STORE environment variable has to be one of memory, file or configmap")
+	return nil
+}
+
+func initWebServer(healthMonitor *apiserver.HealthMonitor, apiMiddlewares ...echo.MiddlewareFunc) *echo.Echo {
 	swagger, err := apiserver.GetSwagger()
 	if err != nil {
 		log.Fatal().Err(err).Msg("Error loading swagger spec")
@@ -96,63 +391,279 @@ func initWebServer(healthMonitor *apiserver.HealthMonitor) *echo.Echo {
 
 	// Log all requests
 	e.Use(lecho.Middleware(lecho.Config{Logger: logger}))
-	// Use our validation middleware to check all requests against the
-	// OpenAPI schema.
-	e.Use(middleware.OapiRequestValidator(swagger))
+
+	// The metrics endpoint is not part of the OpenAPI schema.
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+
+	// Use our validation middleware to check all API requests against the
+	// OpenAPI schema. Tokens are validated by the tokenAuth middleware, which
+	// knows the pod the request is about.
+	validator := middleware.OapiRequestValidatorWithOptions(swagger, &middleware.Options{
+		Options: openapi3filter.Options{
+			AuthenticationFunc: func(context.Context, *openapi3filter.AuthenticationInput) error {
+				return nil
+			},
+		},
+	})
+	api := e.Group("", append([]echo.MiddlewareFunc{validator}, apiMiddlewares...)...)
 
 	// We now register our healthMonitor above as the handler for the interface
-	apiserver.RegisterHandlers(e, healthMonitor)
+	apiserver.RegisterHandlers(api, healthMonitor)
 
 	return e
 }
 
-func initHealthMonitor(podDeletes chan<- apiserver.PodIdentifier, deleteResults <-chan apiserver.PodDeleteResult, config *MonitorConfig) *apiserver.HealthMonitor {
-	return apiserver.NewHealthMonitor(podDeletes, deleteResults, config.RestartThreshold)
-}
-
-func deletePod(podDeletes <-chan apiserver.PodIdentifier, deleteResults chan<- apiserver.PodDeleteResult, clientset kubernetes.Interface) {
-	for {
-		podIdentifier := <-podDeletes
-		podClient := clientset.CoreV1().Pods(podIdentifier.Namespace)
-		err := podClient.Delete(podIdentifier.Name, &metav1.DeleteOptions{})
-		if errors.IsNotFound(err) {
-			log.Warn().
-				Interface("podIdentifier", podIdentifier).
-				Msg("Pod not found")
-		} else if err != nil {
-			log.Error().
-				Err(err).
-				Interface("podIdentifier", podIdentifier).
-				Msg("Error deleting pod")
-		} else {
-			log.Info().
-				Interface("podIdentifier", podIdentifier).
-				Msg("Pod deleted")
-			deleteResults <- apiserver.PodDeleteResult{Identifier: podIdentifier, Success: true}
-			continue
+// initHealthMonitor restores the state right away unless leader election is
+// enabled, in which case only the leader restores it.
+func initHealthMonitor(podDeletes workqueue.Interface, store apiserver.StateStore, policies *policyStore, config *MonitorConfig) *apiserver.HealthMonitor {
+	healthMonitor := apiserver.NewHealthMonitor(podDeletes, policies.resolve, store)
+	if config.ReportHistory > 0 {
+		healthMonitor.ReportHistory = int(config.ReportHistory)
+	}
+	if !config.LeaderElect {
+		healthMonitor.Restore()
+	}
+	return healthMonitor
+}
+
+func initMetrics(healthMonitor *apiserver.HealthMonitor) {
+	prometheus.MustRegister(apiserver.NewHealthCollector(healthMonitor))
+}
+
+// deleteQueue is a rate limited queue of pods to delete. Failed deletions are
+// retried with exponential backoff.
+type deleteQueue struct {
+	workqueue.RateLimitingInterface
+	rateLimiter workqueue.RateLimiter
+}
+
+func initDeleteQueue(config *MonitorConfig) *deleteQueue {
+	rateLimiter := workqueue.NewItemExponentialFailureRateLimiter(config.DeleteRetryBaseDelay, config.DeleteRetryMaxDelay)
+	return &deleteQueue{
+		RateLimitingInterface: workqueue.NewRateLimitingQueue(rateLimiter),
+		rateLimiter:           rateLimiter,
+	}
+}
+
+// retry adds the item back to the queue after its backoff and returns the delay.
+func (q *deleteQueue) retry(item interface{}) time.Duration {
+	delay := q.rateLimiter.When(item)
+	q.AddAfter(item, delay)
+	return delay
+}
+
+// deletePod processes the queue of unhealthy pods until it is shut down. Pods
+// are restarted while keeping within the restart budget of their owners;
+// further deletions of an owner wait until the replacement of an earlier one
+// reports healthy. Failed deletions are retried until the maximum number of
+// attempts is reached.
+func deletePod(queue *deleteQueue, healthMonitor *apiserver.HealthMonitor, clientset kubernetes.Interface, budget *restartBudget, config *MonitorConfig) {
+	for processPodDelete(queue, healthMonitor, clientset, budget, config) {
+	}
+}
+
+func processPodDelete(queue *deleteQueue, healthMonitor *apiserver.HealthMonitor, clientset kubernetes.Interface, budget *restartBudget, config *MonitorConfig) bool {
+	item, shutdown := queue.Get()
+	if shutdown {
+		return false
+	}
+	defer queue.Done(item)
+
+	podIdentifier := item.(apiserver.PodIdentifier)
+
+	if !healthMonitor.IsDeletePending(podIdentifier) {
+		queue.Forget(item)
+		return true
+	}
+
+	policy := healthMonitor.Policies(podIdentifier)
+	if policy.Action == apiserver.ActionNone {
+		log.Info().
+			Interface("podIdentifier", podIdentifier).
+			Str("policy", policy.Name).
+			Msg("Restarting pod was disabled by policy")
+		queue.Forget(item)
+		healthMonitor.CancelDelete(podIdentifier)
+		return true
+	}
+
+	if policy.DryRun {
+		log.Info().
+			Interface("podIdentifier", podIdentifier).
+			Str("action", policy.Action).
+			Str("policy", policy.Name).
+			Msg("Dry run, pod would have been restarted")
+		apiserver.DryRunRestarts.WithLabelValues(podIdentifier.Namespace).Inc()
+		queue.Forget(item)
+		healthMonitor.RecordDryRun(podIdentifier, policy.Action)
+		return true
+	}
+
+	owner, _ := lookupOwner(clientset, podIdentifier)
+	if !budget.acquire(owner, time.Now(), policy.MaxConcurrentRestarts, policy.Cooldown) {
+		log.Info().
+			Interface("podIdentifier", podIdentifier).
+			Str("owner", owner).
+			Str("policy", policy.Name).
+			Msg("Restart budget or cooldown of owner is exhausted, deletion is delayed")
+		queue.AddAfter(item, budget.RecheckInterval)
+		return true
+	}
+
+	attempt := uint32(queue.NumRequeues(item)) + 1
+
+	action, err := remediatePod(clientset, podIdentifier, policy.Action, config)
+	if errors.IsTooManyRequests(err) && attempt >= config.DeleteMaxAttempts && config.EvictionFallback {
+		log.Warn().
+			Interface("podIdentifier", podIdentifier).
+			Msg("Eviction of pod is still blocked, falling back to delete")
+		action, err = remediatePod(clientset, podIdentifier, actionDelete, config)
+	}
+
+	result := apiserver.PodDeleteResult{Identifier: podIdentifier, Action: action}
+	if logRemediationResult(podIdentifier, action, err) {
+		queue.Forget(item)
+		result.Success = true
+		healthMonitor.RecordDeleteResult(result)
+		return true
+	}
+
+	apiserver.DeleteFailures.WithLabelValues(podIdentifier.Namespace).Inc()
+	budget.cancel(owner)
+	result.Error = err.Error()
+
+	// A pod that does not exist anymore cannot be deleted by retrying.
+	if attempt < config.DeleteMaxAttempts && !errors.IsNotFound(err) {
+		delay := queue.retry(item)
+		result.NextRetry = time.Now().Add(delay)
+		log.Info().
+			Interface("podIdentifier", podIdentifier).
+			Uint32("attempt", attempt).
+			Dur("delay", delay).
+			Msg("Deletion of pod will be retried")
+	} else {
+		queue.Forget(item)
+	}
+	healthMonitor.RecordDeleteResult(result)
+	return true
+}
+
+// reapStalePods checks for stale pods every interval. Whether a pod is stale
+// depends on its own interval, which its annotation may override.
+func reapStalePods(healthMonitor *apiserver.HealthMonitor, config *MonitorConfig, interval func(apiserver.PodIdentifier) time.Duration, podExists func(apiserver.PodIdentifier) (bool, error)) {
+	ticker := time.NewTicker(time.Duration(config.Interval) * time.Second)
+	for now := range ticker.C {
+		healthMonitor.ReapStale(now, interval, config.StaleFactor, config.ExpiryFactor, podExists)
+	}
+}
+
+// startRemediation watches the pods, starts deleting unhealthy ones and
+// records events of their health. With leader election enabled, it is only
+// called on the leader.
+func startRemediation(healthMonitor *apiserver.HealthMonitor, podDeletes *deleteQueue, policies *policyStore, clientset kubernetes.Interface, dynamicClient dynamic.Interface, config *MonitorConfig, stopCh <-chan struct{}) {
+	var lister corelisters.PodLister
+	if config.WatchPods {
+		lister = initPodInformer(clientset, healthMonitor, stopCh)
+	}
+
+	policies.setPods(lister)
+	if config.WatchPolicies {
+		policies.watch(dynamicClient, stopCh)
+	}
+
+	var podExists func(apiserver.PodIdentifier) (bool, error)
+	if config.StaleCheckPods {
+		podExists = func(podIdentifier apiserver.PodIdentifier) (bool, error) {
+			var err error
+			if lister != nil {
+				_, err = lister.Pods(podIdentifier.Namespace).Get(podIdentifier.Name)
+			} else {
+				_, err = clientset.CoreV1().Pods(podIdentifier.Namespace).Get(podIdentifier.Name, metav1.GetOptions{})
+			}
+			if errors.IsNotFound(err) {
+				return false, nil
+			}
+			return err == nil, err
 		}
-		deleteResults <- apiserver.PodDeleteResult{Identifier: podIdentifier, Success: false}
 	}
+
+	recoveries := watchRecoveries(healthMonitor)
+	budget := newRestartBudget(time.Duration(config.RestartTimeout) * time.Second)
+
+	events := watchEvents(healthMonitor)
+
+	go recordEvents(events, clientset, initEventRecorder(clientset))
+	go completeRestarts(recoveries, clientset, budget)
+	go deletePod(podDeletes, healthMonitor, clientset, budget, config)
+	go reapStalePods(healthMonitor, config, policies.interval, podExists)
 }
 
 func main() {
 	var port = flag.Int("port", 8080, "Port for HTTP server")
+	var certFile = flag.String("tls-cert-file", "", "TLS certificate file, enables HTTPS")
+	var keyFile = flag.String("tls-key-file", "", "TLS key file")
+	var clientCAFile = flag.String("tls-client-ca-file", "", "CA file to verify client certificates, enables mutual TLS")
 	flag.Parse()
 
 	config := initConfig()
 	initLogging(config)
-	clientset := initKubernetes()
-	podDeletes := make(chan apiserver.PodIdentifier)
-	deleteResults := make(chan apiserver.PodDeleteResult)
-	healthMonitor := initHealthMonitor(podDeletes, deleteResults, config)
-	e := initWebServer(healthMonitor)
+	clientset, dynamicClient := initKubernetes()
+	store := initStateStore(config, clientset)
+	podDeletes := initDeleteQueue(config)
+	policies := newPolicyStore(config)
+	healthMonitor := initHealthMonitor(podDeletes, store, policies, config)
+	initMetrics(healthMonitor)
+
+	var certs *certReloader
+	if *certFile != "" {
+		var err error
+		certs, err = newCertReloader(*certFile, *keyFile, *clientCAFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not load TLS certificate")
+		}
+		go certs.watch(time.Minute, make(chan struct{}))
+	} else if *clientCAFile != "" {
+		log.Fatal().Msg("Mutual TLS requires a TLS certificate")
+	}
+
+	limiter := newRateLimiter(config.RateLimit, config.RateLimitBurst, policies.interval)
+	apiMiddlewares := []echo.MiddlewareFunc{limiter.Global}
+	if config.TokenAuth {
+		apiMiddlewares = append(apiMiddlewares, newTokenAuth(clientset, config).Middleware)
+	} else {
+		log.Warn().Msg("Health reports are not authenticated")
+	}
+	if config.PodRateLimit {
+		apiMiddlewares = append(apiMiddlewares, limiter.PerPod)
+	}
+
+	var e *echo.Echo
+	if config.LeaderElect {
+		proxy := newLeaderProxy(clientset, config, *port)
+		if certs != nil {
+			proxy.useTLS(certs.proxyConfig())
+		}
+		e = initWebServer(healthMonitor, append(apiMiddlewares, proxy.Middleware)...)
+
+		go runLeaderElection(context.Background(), clientset, config, proxy, healthMonitor.Restore, func(ctx context.Context) {
+			startRemediation(healthMonitor, podDeletes, policies, clientset, dynamicClient, config, ctx.Done())
+		})
+	} else {
+		e = initWebServer(healthMonitor, apiMiddlewares...)
+		startRemediation(healthMonitor, podDeletes, policies, clientset, dynamicClient, config, make(chan struct{}))
+	}
 
 	if config.Debug {
 		e.Debug = true
 	}
 
-	go deletePod(podDeletes, deleteResults, clientset)
+	address := fmt.Sprintf("0.0.0.0:%d", *port)
+	if certs != nil {
+		e.TLSServer.Addr = address
+		e.TLSServer.TLSConfig = certs.serverConfig()
+		e.Logger.Fatal(e.StartServer(e.TLSServer))
+	}
 
 	// And we serve HTTP until the world ends.
-	e.Logger.Fatal(e.Start(fmt.Sprintf("0.0.0.0:%d", *port)))
+	e.Logger.Fatal(e.Start(address))
 }
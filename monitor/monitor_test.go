@@ -1,27 +1,66 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	mathrand "math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/derfetzer/longhorn-monitor/monitor/apiserver"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	appsv1 "k8s.io/api/apps/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
 	v1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 
 	"github.com/deepmap/oapi-codegen/pkg/testutil"
+	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 )
 
+// nextPodDelete takes the next pod from the delete queue.
+func nextPodDelete(queue workqueue.Interface) interface{} {
+	item, _ := queue.Get()
+	queue.Done(item)
+	return item
+}
+
 func TestHealthMonitor(t *testing.T) {
 	assert := assert.New(t)
 
-	podDeletes := make(chan apiserver.PodIdentifier, 1)
-	deleteResults := make(chan apiserver.PodDeleteResult, 1)
+	podDeletes := workqueue.New()
 
-	healthMonitor := initHealthMonitor(podDeletes, deleteResults, &MonitorConfig{RestartThreshold: 4})
+	config := &MonitorConfig{RestartThreshold: 4}
+	healthMonitor := initHealthMonitor(podDeletes, apiserver.NewMemoryStateStore(), newPolicyStore(config), config)
 
 	e := initWebServer(healthMonitor)
 
@@ -32,7 +71,7 @@ func TestHealthMonitor(t *testing.T) {
 
 	result := testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
 	assert.Equal(http.StatusCreated, result.Code())
-	assert.Empty(podDeletes)
+	assert.Equal(0, podDeletes.Len())
 
 	q = make(url.Values)
 	q.Set("podName", "testPod2")
@@ -47,6 +86,7 @@ func TestHealthMonitor(t *testing.T) {
 	assert.Equal(http.StatusOK, result.Code())
 	err := result.UnmarshalBodyToObject(&resultList)
 	assert.NoError(err, "error unmarshaling response")
+	stripReports(resultList)
 	assert.Equal(2, len(resultList))
 	assert.Contains(resultList, apiserver.PodHealth{
 		ErrorCount: 0,
@@ -62,7 +102,7 @@ func TestHealthMonitor(t *testing.T) {
 		Namespace:  "default",
 		IsDeleted:  false,
 	})
-	assert.Empty(podDeletes)
+	assert.Equal(0, podDeletes.Len())
 
 	q = make(url.Values)
 	q.Set("podName", "testPod")
@@ -79,6 +119,7 @@ func TestHealthMonitor(t *testing.T) {
 	assert.Equal(http.StatusOK, result.Code())
 	err = result.UnmarshalBodyToObject(&resultList2)
 	assert.NoError(err, "error unmarshaling response")
+	stripReports(resultList2)
 	assert.Equal(2, len(resultList2))
 	assert.Contains(resultList2, apiserver.PodHealth{
 		ErrorCount: 3,
@@ -94,39 +135,39 @@ func TestHealthMonitor(t *testing.T) {
 		Namespace:  "default",
 		IsDeleted:  false,
 	})
-	assert.Empty(podDeletes)
+	assert.Equal(0, podDeletes.Len())
 
 	result = testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
 	assert.Equal(http.StatusOK, result.Code())
 
-	if assert.NotEmpty(podDeletes) {
-		assert.Equal(1, len(podDeletes))
-		assert.Equal(apiserver.PodIdentifier{Name: "testPod", Namespace: "default"}, <-podDeletes)
+	if assert.Equal(1, podDeletes.Len()) {
+		assert.Equal(apiserver.PodIdentifier{Name: "testPod", Namespace: "default"}, nextPodDelete(podDeletes))
 	}
 
 	// Simulate successful delete
-	deleteResults <- apiserver.PodDeleteResult{
+	healthMonitor.RecordDeleteResult(apiserver.PodDeleteResult{
 		Identifier: apiserver.PodIdentifier{
 			Name:      "testPod",
 			Namespace: "default",
 		},
 		Success: true,
-	}
-
-	time.Sleep(100 * time.Millisecond)
+	})
 
 	result = testutil.NewRequest().Get("/podHealth").Go(t, e)
 	var resultList3 []apiserver.PodHealth
 	assert.Equal(http.StatusOK, result.Code())
 	err = result.UnmarshalBodyToObject(&resultList3)
+	stripReports(resultList3)
+	oneAttempt := int32(1)
 	assert.NoError(err, "error unmarshaling response")
 	assert.Equal(2, len(resultList3))
 	assert.Contains(resultList3, apiserver.PodHealth{
-		ErrorCount: 4,
-		IsHealthy:  false,
-		PodName:    "testPod",
-		Namespace:  "default",
-		IsDeleted:  true,
+		ErrorCount:     4,
+		IsHealthy:      false,
+		PodName:        "testPod",
+		Namespace:      "default",
+		IsDeleted:      true,
+		DeleteAttempts: &oneAttempt,
 	})
 	assert.Contains(resultList3, apiserver.PodHealth{
 		ErrorCount: 0,
@@ -135,7 +176,7 @@ func TestHealthMonitor(t *testing.T) {
 		Namespace:  "default",
 		IsDeleted:  false,
 	})
-	assert.Empty(podDeletes)
+	assert.Equal(0, podDeletes.Len())
 
 	q = make(url.Values)
 	q.Set("podName", "testPod")
@@ -150,13 +191,15 @@ func TestHealthMonitor(t *testing.T) {
 	assert.Equal(http.StatusOK, result.Code())
 	err = result.UnmarshalBodyToObject(&resultList4)
 	assert.NoError(err, "error unmarshaling response")
+	stripReports(resultList4)
 	assert.Equal(2, len(resultList4))
 	assert.Contains(resultList4, apiserver.PodHealth{
-		ErrorCount: 4,
-		IsHealthy:  false,
-		PodName:    "testPod",
-		Namespace:  "default",
-		IsDeleted:  true,
+		ErrorCount:     4,
+		IsHealthy:      false,
+		PodName:        "testPod",
+		Namespace:      "default",
+		IsDeleted:      true,
+		DeleteAttempts: &oneAttempt,
 	})
 	assert.Contains(resultList4, apiserver.PodHealth{
 		ErrorCount: 0,
@@ -165,7 +208,7 @@ func TestHealthMonitor(t *testing.T) {
 		Namespace:  "default",
 		IsDeleted:  false,
 	})
-	assert.Empty(podDeletes)
+	assert.Equal(0, podDeletes.Len())
 
 	q = make(url.Values)
 	q.Set("podName", "testPod")
@@ -179,6 +222,7 @@ func TestHealthMonitor(t *testing.T) {
 	assert.Equal(http.StatusOK, result.Code())
 	err = result.UnmarshalBodyToObject(&resultList5)
 	assert.NoError(err, "error unmarshaling response")
+	stripReports(resultList5)
 	assert.Equal(1, len(resultList5))
 	assert.Contains(resultList5, apiserver.PodHealth{
 		ErrorCount: 0,
@@ -187,7 +231,88 @@ func TestHealthMonitor(t *testing.T) {
 		Namespace:  "default",
 		IsDeleted:  false,
 	})
-	assert.Empty(podDeletes)
+	assert.Equal(0, podDeletes.Len())
+}
+
+// addEvictionReactor makes the fake clientset delete evicted pods like the API server.
+func addEvictionReactor(clientset *fake.Clientset) {
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		eviction := action.(k8stesting.CreateAction).GetObject().(*policyv1beta1.Eviction)
+		err := clientset.Tracker().Delete(action.GetResource(), eviction.Namespace, eviction.Name)
+		return true, nil, err
+	})
+}
+
+// markForDeletion reports the pod as unhealthy until its deletion is queued.
+func markForDeletion(t *testing.T, healthMonitor *apiserver.HealthMonitor, podIdentifier apiserver.PodIdentifier) {
+	e := initWebServer(healthMonitor)
+
+	q := make(url.Values)
+	q.Set("podName", podIdentifier.Name)
+	q.Set("namespace", podIdentifier.Namespace)
+	q.Set("isHealthy", "false")
+
+	// The threshold is not checked on the first report, which registers the pod.
+	threshold := healthMonitor.Policies(podIdentifier).Threshold
+	for i := uint32(0); i < 2 || i < threshold; i++ {
+		testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+	}
+}
+
+// stripReports drops the reports of the pods, they are covered by TestReports.
+func stripReports(resultList []apiserver.PodHealth) {
+	for i := range resultList {
+		resultList[i].Reports = nil
+	}
+}
+
+// stateRecorder keeps the saved entries in memory, so that the tests can
+// inspect the entries of a health monitor after flushing it.
+type stateRecorder struct {
+	pods map[apiserver.PodIdentifier]*apiserver.HealthStatus
+	lock sync.Mutex
+}
+
+func newStateRecorder() *stateRecorder {
+	return &stateRecorder{pods: make(map[apiserver.PodIdentifier]*apiserver.HealthStatus)}
+}
+
+func (s *stateRecorder) Load() (map[apiserver.PodIdentifier]*apiserver.HealthStatus, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	pods := make(map[apiserver.PodIdentifier]*apiserver.HealthStatus, len(s.pods))
+	for podIdentifier, healthStatus := range s.pods {
+		copied := *healthStatus
+		pods[podIdentifier] = &copied
+	}
+	return pods, nil
+}
+
+func (s *stateRecorder) Save(pods map[apiserver.PodIdentifier]*apiserver.HealthStatus) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pods = pods
+	return nil
+}
+
+// recordedPods flushes the health monitor, whose store has to be a
+// stateRecorder, and returns its entries.
+func recordedPods(healthMonitor *apiserver.HealthMonitor) map[apiserver.PodIdentifier]*apiserver.HealthStatus {
+	healthMonitor.Flush()
+	pods, _ := healthMonitor.Store.(*stateRecorder).Load()
+	return pods
+}
+
+func podHealthStatus(healthMonitor *apiserver.HealthMonitor, podIdentifier apiserver.PodIdentifier) apiserver.HealthStatus {
+	if healthStatus, p := recordedPods(healthMonitor)[podIdentifier]; p {
+		return *healthStatus
+	}
+	return apiserver.HealthStatus{}
 }
 
 func TestDeletePod(t *testing.T) {
@@ -202,51 +327,1793 @@ func TestDeletePod(t *testing.T) {
 		},
 	)
 
-	podDeletes := make(chan apiserver.PodIdentifier)
-	deleteResults := make(chan apiserver.PodDeleteResult, 1)
-	go deletePod(podDeletes, deleteResults, clientset)
+	addEvictionReactor(clientset)
+
+	config := &MonitorConfig{RemediationAction: actionEvict, DeleteMaxAttempts: 3}
+	podDeletes := initDeleteQueue(config)
+	defer podDeletes.ShutDown()
+	healthMonitor := initHealthMonitor(podDeletes, newStateRecorder(), newPolicyStore(config), config)
+	go deletePod(podDeletes, healthMonitor, clientset, newRestartBudget(time.Minute), config)
 
 	l, _ := clientset.CoreV1().Pods("").List(metav1.ListOptions{})
 	assert.Equal(2, len(l.Items))
 
-	podDeletes <- apiserver.PodIdentifier{
-		Name:      "unknown",
-		Namespace: "default",
-	}
+	unknown := apiserver.PodIdentifier{Name: "unknown", Namespace: "default"}
+	markForDeletion(t, healthMonitor, unknown)
 
-	time.Sleep(100 * time.Millisecond)
+	// A pod that does not exist is not retried
+	assert.Eventually(func() bool {
+		return !podHealthStatus(healthMonitor, unknown).IsDeletePending
+	}, time.Second, 10*time.Millisecond)
 
-	if assert.NotEmpty(deleteResults) {
-		assert.Equal(1, len(deleteResults))
-		assert.Equal(apiserver.PodDeleteResult{
-			Identifier: apiserver.PodIdentifier{
-				Name:      "unknown",
-				Namespace: "default",
-			},
-			Success: false}, <-deleteResults)
-	}
+	healthStatus := podHealthStatus(healthMonitor, unknown)
+	assert.True(healthStatus.HasDeleteError)
+	assert.False(healthStatus.IsDeleted)
+	assert.Equal(uint32(1), healthStatus.DeleteAttempts)
+	assert.Contains(healthStatus.LastDeleteError, "not found")
+	assert.True(healthStatus.NextDeleteRetry.IsZero())
 
 	l, _ = clientset.CoreV1().Pods("").List(metav1.ListOptions{})
 	assert.Equal(2, len(l.Items))
 
-	podDeletes <- apiserver.PodIdentifier{
-		Name:      "testPod",
-		Namespace: "default",
-	}
+	testPod := apiserver.PodIdentifier{Name: "testPod", Namespace: "default"}
+	markForDeletion(t, healthMonitor, testPod)
 
-	time.Sleep(100 * time.Millisecond)
+	assert.Eventually(func() bool {
+		return podHealthStatus(healthMonitor, testPod).IsDeleted
+	}, time.Second, 10*time.Millisecond)
 
-	if assert.NotEmpty(deleteResults) {
-		assert.Equal(1, len(deleteResults))
-		assert.Equal(apiserver.PodDeleteResult{
-			Identifier: apiserver.PodIdentifier{
-				Name:      "testPod",
-				Namespace: "default",
-			},
-			Success: true}, <-deleteResults)
-	}
+	healthStatus = podHealthStatus(healthMonitor, testPod)
+	assert.False(healthStatus.HasDeleteError)
+	assert.False(healthStatus.IsDeletePending)
+	assert.Equal(actionEvict, healthStatus.RemediationAction)
 
 	l, _ = clientset.CoreV1().Pods("").List(metav1.ListOptions{})
 	assert.Equal(1, len(l.Items))
 	assert.Equal("testPod2", l.Items[0].GetName())
 }
+
+func TestDeletePodRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	clientset := fake.NewSimpleClientset(
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "flaky", Namespace: "default"},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "broken", Namespace: "default"},
+		},
+	)
+
+	// Deleting "flaky" fails twice, deleting "broken" always fails
+	failures := 2
+	clientset.PrependReactor("delete", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		name := action.(k8stesting.DeleteAction).GetName()
+		if name == "broken" || (name == "flaky" && failures > 0) {
+			if name == "flaky" {
+				failures--
+			}
+			return true, nil, errors.NewInternalError(fmt.Errorf("etcd is down"))
+		}
+		return false, nil, nil
+	})
+
+	config := &MonitorConfig{
+		RemediationAction:    actionDelete,
+		DeleteMaxAttempts:    3,
+		DeleteRetryBaseDelay: 50 * time.Millisecond,
+		DeleteRetryMaxDelay:  time.Second,
+	}
+	podDeletes := initDeleteQueue(config)
+	defer podDeletes.ShutDown()
+	healthMonitor := initHealthMonitor(podDeletes, newStateRecorder(), newPolicyStore(config), config)
+
+	flaky := apiserver.PodIdentifier{Name: "flaky", Namespace: "default"}
+	broken := apiserver.PodIdentifier{Name: "broken", Namespace: "default"}
+	markForDeletion(t, healthMonitor, flaky)
+	markForDeletion(t, healthMonitor, broken)
+
+	go deletePod(podDeletes, healthMonitor, clientset, newRestartBudget(time.Minute), config)
+
+	// The failed attempt is visible while the retry is pending
+	assert.Eventually(func() bool {
+		return podHealthStatus(healthMonitor, flaky).DeleteAttempts == 1
+	}, time.Second, time.Millisecond)
+
+	healthStatus := podHealthStatus(healthMonitor, flaky)
+	assert.True(healthStatus.IsDeletePending)
+	assert.True(healthStatus.HasDeleteError)
+	assert.Contains(healthStatus.LastDeleteError, "etcd is down")
+	assert.False(healthStatus.NextDeleteRetry.IsZero())
+
+	assert.Eventually(func() bool {
+		return podHealthStatus(healthMonitor, flaky).IsDeleted
+	}, 2*time.Second, 10*time.Millisecond)
+
+	healthStatus = podHealthStatus(healthMonitor, flaky)
+	assert.Equal(uint32(3), healthStatus.DeleteAttempts)
+	assert.False(healthStatus.HasDeleteError)
+	assert.Empty(healthStatus.LastDeleteError)
+	assert.True(healthStatus.NextDeleteRetry.IsZero())
+
+	// Giving up after the maximum number of attempts
+	assert.Eventually(func() bool {
+		return !podHealthStatus(healthMonitor, broken).IsDeletePending
+	}, 2*time.Second, 10*time.Millisecond)
+
+	healthStatus = podHealthStatus(healthMonitor, broken)
+	assert.Equal(uint32(3), healthStatus.DeleteAttempts)
+	assert.True(healthStatus.HasDeleteError)
+	assert.False(healthStatus.IsDeleted)
+	assert.True(healthStatus.NextDeleteRetry.IsZero())
+	assert.Equal(0, podDeletes.Len())
+}
+
+func testStateStore(t *testing.T, store apiserver.StateStore) {
+	assert := assert.New(t)
+
+	podDeletes := workqueue.New()
+
+	config := &MonitorConfig{RestartThreshold: 3}
+	healthMonitor := initHealthMonitor(podDeletes, store, newPolicyStore(config), config)
+	e := initWebServer(healthMonitor)
+
+	q := make(url.Values)
+	q.Set("podName", "testPod")
+	q.Set("namespace", "default")
+	q.Set("isHealthy", "false")
+
+	result := testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+	assert.Equal(http.StatusCreated, result.Code())
+	result = testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+	assert.Equal(http.StatusOK, result.Code())
+
+	// Simulate a restart of the monitor
+	healthMonitor.Flush()
+	healthMonitor = initHealthMonitor(podDeletes, store, newPolicyStore(config), config)
+	e = initWebServer(healthMonitor)
+
+	result = testutil.NewRequest().Get("/podHealth").Go(t, e)
+	var resultList []apiserver.PodHealth
+	assert.Equal(http.StatusOK, result.Code())
+	err := result.UnmarshalBodyToObject(&resultList)
+	assert.NoError(err, "error unmarshaling response")
+	// The reports are not persisted
+	assert.Equal(1, len(resultList))
+	assert.Nil(resultList[0].Reports)
+	assert.Equal([]apiserver.PodHealth{{
+		ErrorCount: 2,
+		IsHealthy:  false,
+		PodName:    "testPod",
+		Namespace:  "default",
+		IsDeleted:  false,
+	}}, resultList)
+	assert.Equal(0, podDeletes.Len())
+
+	result = testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+	assert.Equal(http.StatusOK, result.Code())
+
+	if assert.Equal(1, podDeletes.Len()) {
+		assert.Equal(apiserver.PodIdentifier{Name: "testPod", Namespace: "default"}, nextPodDelete(podDeletes))
+	}
+}
+
+func TestFileStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "longhorn-monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testStateStore(t, apiserver.NewFileStateStore(filepath.Join(dir, "state.json")))
+}
+
+func TestConfigMapStateStore(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	testStateStore(t, apiserver.NewConfigMapStateStore(clientset.CoreV1().ConfigMaps("longhorn-addon"), "longhorn-monitor-state"))
+
+	_, err := clientset.CoreV1().ConfigMaps("longhorn-addon").Get("longhorn-monitor-state", metav1.GetOptions{})
+	assert.NoError(t, err)
+}
+
+func TestReapStale(t *testing.T) {
+	assert := assert.New(t)
+
+	podDeletes := workqueue.New()
+
+	config := &MonitorConfig{RestartThreshold: 3}
+	healthMonitor := initHealthMonitor(podDeletes, apiserver.NewMemoryStateStore(), newPolicyStore(config), config)
+	e := initWebServer(healthMonitor)
+
+	for _, podName := range []string{"testPod", "testPod2"} {
+		q := make(url.Values)
+		q.Set("podName", podName)
+		q.Set("namespace", "default")
+		q.Set("isHealthy", "true")
+
+		result := testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+		assert.Equal(http.StatusCreated, result.Code())
+	}
+
+	podExists := func(podIdentifier apiserver.PodIdentifier) (bool, error) {
+		return podIdentifier.Name == "testPod", nil
+	}
+	interval := func(podIdentifier apiserver.PodIdentifier) time.Duration {
+		if podIdentifier.Name == "slowPod" {
+			return 5 * time.Minute
+		}
+		return time.Minute
+	}
+
+	// Nothing is stale yet
+	healthMonitor.ReapStale(time.Now(), interval, 1, 10, podExists)
+
+	result := testutil.NewRequest().Get("/podHealth").Go(t, e)
+	var resultList []apiserver.PodHealth
+	err := result.UnmarshalBodyToObject(&resultList)
+	assert.NoError(err, "error unmarshaling response")
+	stripReports(resultList)
+	assert.Equal(2, len(resultList))
+
+	// testPod is stale but still exists, testPod2 is gone
+	healthMonitor.ReapStale(time.Now().Add(2*time.Minute), interval, 1, 10, podExists)
+
+	result = testutil.NewRequest().Get("/podHealth").Go(t, e)
+	var resultList2 []apiserver.PodHealth
+	err = result.UnmarshalBodyToObject(&resultList2)
+	assert.NoError(err, "error unmarshaling response")
+	stripReports(resultList2)
+	assert.Equal([]apiserver.PodHealth{{
+		ErrorCount: 0,
+		IsHealthy:  true,
+		PodName:    "testPod",
+		Namespace:  "default",
+		IsDeleted:  false,
+		IsStale:    true,
+	}}, resultList2)
+
+	// Reporting again clears the stale state
+	q := make(url.Values)
+	q.Set("podName", "testPod")
+	q.Set("namespace", "default")
+	q.Set("isHealthy", "true")
+
+	result = testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+	assert.Equal(http.StatusOK, result.Code())
+
+	result = testutil.NewRequest().Get("/podHealth").Go(t, e)
+	var resultList3 []apiserver.PodHealth
+	err = result.UnmarshalBodyToObject(&resultList3)
+	assert.NoError(err, "error unmarshaling response")
+	stripReports(resultList3)
+	assert.Equal(1, len(resultList3))
+	assert.False(resultList3[0].IsStale)
+
+	// Without a pod check, stale entries are kept until they expire
+	healthMonitor.ReapStale(time.Now().Add(2*time.Minute), interval, 1, 10, nil)
+
+	result = testutil.NewRequest().Get("/podHealth").Go(t, e)
+	var resultList4 []apiserver.PodHealth
+	err = result.UnmarshalBodyToObject(&resultList4)
+	assert.NoError(err, "error unmarshaling response")
+	stripReports(resultList4)
+	assert.Equal(1, len(resultList4))
+	assert.True(resultList4[0].IsStale)
+
+	healthMonitor.ReapStale(time.Now().Add(11*time.Minute), interval, 1, 10, nil)
+
+	result = testutil.NewRequest().Get("/podHealth").Go(t, e)
+	var resultList5 []apiserver.PodHealth
+	err = result.UnmarshalBodyToObject(&resultList5)
+	assert.NoError(err, "error unmarshaling response")
+	stripReports(resultList5)
+	assert.Empty(resultList5)
+
+	// Pods reporting less often become stale later
+	q.Set("podName", "slowPod")
+	result = testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+	assert.Equal(http.StatusCreated, result.Code())
+	healthMonitor.ReapStale(time.Now().Add(2*time.Minute), interval, 1, 10, nil)
+
+	result = testutil.NewRequest().Get("/podHealth").Go(t, e)
+	var resultList6 []apiserver.PodHealth
+	err = result.UnmarshalBodyToObject(&resultList6)
+	assert.NoError(err, "error unmarshaling response")
+	assert.Equal(1, len(resultList6))
+	assert.False(resultList6[0].IsStale)
+}
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	podDeletes := workqueue.New()
+
+	config := &MonitorConfig{RestartThreshold: 3}
+	healthMonitor := initHealthMonitor(podDeletes, apiserver.NewMemoryStateStore(), newPolicyStore(config), config)
+	e := initWebServer(healthMonitor)
+
+	q := make(url.Values)
+	q.Set("podName", "testPod")
+	q.Set("namespace", "default")
+	q.Set("isHealthy", "false")
+
+	result := testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+	assert.Equal(http.StatusCreated, result.Code())
+	result = testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+	assert.Equal(http.StatusOK, result.Code())
+
+	result = testutil.NewRequest().Get("/metrics").Go(t, e)
+	assert.Equal(http.StatusOK, result.Code())
+	assert.Contains(result.Recorder.Body.String(), `longhorn_monitor_health_reports_total{healthy="false"}`)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(apiserver.NewHealthCollector(healthMonitor))
+
+	metricFamilies, err := registry.Gather()
+	assert.NoError(err)
+
+	values := make(map[string]float64)
+	for _, metricFamily := range metricFamilies {
+		for _, metric := range metricFamily.GetMetric() {
+			values[metricFamily.GetName()] = metric.GetGauge().GetValue()
+		}
+	}
+	assert.Equal(2.0, values["longhorn_monitor_pod_error_count"])
+	assert.Equal(0.0, values["longhorn_monitor_pod_deleted"])
+	assert.Equal(0.0, values["longhorn_monitor_pod_delete_pending"])
+	assert.Contains(values, "longhorn_monitor_pod_last_seen_seconds")
+}
+
+func TestPodInformer(t *testing.T) {
+	assert := assert.New(t)
+
+	clientset := fake.NewSimpleClientset(
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "testPod", Namespace: "default", UID: "uid1"},
+		},
+	)
+
+	podDeletes := workqueue.New()
+
+	store := apiserver.NewMemoryStateStore()
+	config := &MonitorConfig{RestartThreshold: 1}
+	healthMonitor := initHealthMonitor(podDeletes, store, newPolicyStore(config), config)
+	e := initWebServer(healthMonitor)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	initPodInformer(clientset, healthMonitor, stopCh)
+
+	getHealth := func() []apiserver.PodHealth {
+		result := testutil.NewRequest().Get("/podHealth").Go(t, e)
+		var resultList []apiserver.PodHealth
+		err := result.UnmarshalBodyToObject(&resultList)
+		assert.NoError(err, "error unmarshaling response")
+		stripReports(resultList)
+		return resultList
+	}
+
+	q := make(url.Values)
+	q.Set("podName", "testPod")
+	q.Set("namespace", "default")
+	q.Set("podUid", "uid1")
+	q.Set("isHealthy", "false")
+
+	result := testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+	assert.Equal(http.StatusCreated, result.Code())
+	result = testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+	assert.Equal(http.StatusOK, result.Code())
+	assert.Equal(apiserver.PodIdentifier{Name: "testPod", Namespace: "default"}, nextPodDelete(podDeletes))
+
+	healthMonitor.RecordDeleteResult(apiserver.PodDeleteResult{
+		Identifier: apiserver.PodIdentifier{Name: "testPod", Namespace: "default"},
+		Success:    true,
+	})
+	assert.Eventually(func() bool {
+		resultList := getHealth()
+		return len(resultList) == 1 && resultList[0].IsDeleted
+	}, time.Second, 10*time.Millisecond)
+
+	// A StatefulSet recreates the pod with the same name
+	err := clientset.CoreV1().Pods("default").Delete("testPod", &metav1.DeleteOptions{})
+	assert.NoError(err)
+	_, err = clientset.CoreV1().Pods("default").Create(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "testPod", Namespace: "default", UID: "uid2"},
+	})
+	assert.NoError(err)
+
+	assert.Eventually(func() bool {
+		return len(getHealth()) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	q.Set("podUid", "uid2")
+	q.Set("isHealthy", "true")
+	result = testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+	assert.Equal(http.StatusCreated, result.Code())
+
+	assert.Equal([]apiserver.PodHealth{{
+		ErrorCount: 0,
+		IsHealthy:  true,
+		PodName:    "testPod",
+		Namespace:  "default",
+	}}, getHealth())
+
+	// The pod vanishes
+	err = clientset.CoreV1().Pods("default").Delete("testPod", &metav1.DeleteOptions{})
+	assert.NoError(err)
+
+	assert.Eventually(func() bool {
+		return len(getHealth()) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRecreatedPodWithoutUID(t *testing.T) {
+	assert := assert.New(t)
+
+	podDeletes := workqueue.New()
+	config := &MonitorConfig{RestartThreshold: 1}
+	healthMonitor := initHealthMonitor(podDeletes, apiserver.NewMemoryStateStore(), newPolicyStore(config), config)
+	e := initWebServer(healthMonitor)
+
+	// The entry was registered without UID, e.g. by an older health check
+	q := make(url.Values)
+	q.Set("podName", "testPod")
+	q.Set("namespace", "default")
+	q.Set("isHealthy", "false")
+	assert.Equal(http.StatusCreated, testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e).Code())
+	assert.Equal(http.StatusOK, testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e).Code())
+	assert.Equal(apiserver.PodIdentifier{Name: "testPod", Namespace: "default"}, nextPodDelete(podDeletes))
+	healthMonitor.RecordDeleteResult(apiserver.PodDeleteResult{
+		Identifier: apiserver.PodIdentifier{Name: "testPod", Namespace: "default"},
+		Success:    true,
+	})
+
+	// Without watching the pods, the recreated pod is recognized by its UID
+	q.Set("podUid", "uid2")
+	q.Set("isHealthy", "true")
+	assert.Equal(http.StatusCreated, testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e).Code())
+
+	result := testutil.NewRequest().Get("/podHealth").Go(t, e)
+	var resultList []apiserver.PodHealth
+	err := result.UnmarshalBodyToObject(&resultList)
+	assert.NoError(err, "error unmarshaling response")
+	stripReports(resultList)
+	assert.Equal([]apiserver.PodHealth{{
+		ErrorCount: 0,
+		IsHealthy:  true,
+		PodName:    "testPod",
+		Namespace:  "default",
+	}}, resultList)
+
+	// The recreated pod keeps its entry
+	assert.Equal(http.StatusOK, testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e).Code())
+}
+
+func TestRestartBudget(t *testing.T) {
+	assert := assert.New(t)
+
+	isController := true
+	deploymentRef := metav1.OwnerReference{Kind: "Deployment", Name: "web", Controller: &isController}
+	replicaSetRef := metav1.OwnerReference{Kind: "ReplicaSet", Name: "web-abc", Controller: &isController}
+
+	clientset := fake.NewSimpleClientset(
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-abc", Namespace: "default", OwnerReferences: []metav1.OwnerReference{deploymentRef}},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-abc-1", Namespace: "default", OwnerReferences: []metav1.OwnerReference{replicaSetRef}},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-abc-2", Namespace: "default", OwnerReferences: []metav1.OwnerReference{replicaSetRef}},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "standalone", Namespace: "default"},
+		},
+	)
+	addEvictionReactor(clientset)
+
+	config := &MonitorConfig{RemediationAction: actionEvict, DeleteMaxAttempts: 1, MaxRestarts: 1}
+	podDeletes := initDeleteQueue(config)
+	defer podDeletes.ShutDown()
+	healthMonitor := initHealthMonitor(podDeletes, newStateRecorder(), newPolicyStore(config), config)
+
+	budget := newRestartBudget(time.Hour)
+	budget.RecheckInterval = 10 * time.Millisecond
+	recoveries := make(chan apiserver.PodIdentifier)
+	go completeRestarts(recoveries, clientset, budget)
+	go deletePod(podDeletes, healthMonitor, clientset, budget, config)
+
+	web1 := apiserver.PodIdentifier{Name: "web-abc-1", Namespace: "default"}
+	web2 := apiserver.PodIdentifier{Name: "web-abc-2", Namespace: "default"}
+	standalone := apiserver.PodIdentifier{Name: "standalone", Namespace: "default"}
+	markForDeletion(t, healthMonitor, web1)
+	markForDeletion(t, healthMonitor, web2)
+	markForDeletion(t, healthMonitor, standalone)
+
+	assert.Eventually(func() bool {
+		return podHealthStatus(healthMonitor, web1).IsDeleted && podHealthStatus(healthMonitor, standalone).IsDeleted
+	}, time.Second, 10*time.Millisecond)
+
+	// The second replica waits for the replacement of the first one
+	time.Sleep(100 * time.Millisecond)
+	assert.True(podHealthStatus(healthMonitor, web2).IsDeletePending)
+
+	// A replica that existed before the restart does not finish it
+	recoveries <- web2
+
+	time.Sleep(100 * time.Millisecond)
+	assert.True(podHealthStatus(healthMonitor, web2).IsDeletePending)
+
+	_, err := clientset.CoreV1().Pods("default").Create(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "web-abc-3",
+			Namespace:         "default",
+			OwnerReferences:   []metav1.OwnerReference{replicaSetRef},
+			CreationTimestamp: metav1.NewTime(time.Now().Add(time.Minute)),
+		},
+	})
+	assert.NoError(err)
+
+	recoveries <- apiserver.PodIdentifier{Name: "web-abc-3", Namespace: "default"}
+
+	assert.Eventually(func() bool {
+		return podHealthStatus(healthMonitor, web2).IsDeleted
+	}, time.Second, 10*time.Millisecond)
+
+	l, _ := clientset.CoreV1().Pods("").List(metav1.ListOptions{})
+	assert.Equal(1, len(l.Items))
+	assert.Equal("web-abc-3", l.Items[0].GetName())
+}
+
+func TestRemediationActions(t *testing.T) {
+	assert := assert.New(t)
+
+	clientset := fake.NewSimpleClientset(
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "testPod", Namespace: "default"},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "testPod", Namespace: "stuck"},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "testPod", Namespace: "protected"},
+		},
+	)
+	addEvictionReactor(clientset)
+
+	// The PodDisruptionBudget blocks the first eviction
+	blocked := 1
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" || action.GetNamespace() != "protected" || blocked == 0 {
+			return false, nil, nil
+		}
+		blocked--
+		return true, nil, errors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 10)
+	})
+
+	gracePeriod := int64(30)
+	config := &MonitorConfig{
+		RemediationAction:    actionDelete,
+		NamespaceActions:     map[string]string{"stuck": actionForceDelete, "protected": actionEvict},
+		GracePeriod:          &gracePeriod,
+		DeleteMaxAttempts:    2,
+		DeleteRetryBaseDelay: 10 * time.Millisecond,
+		DeleteRetryMaxDelay:  10 * time.Millisecond,
+	}
+	podDeletes := initDeleteQueue(config)
+	defer podDeletes.ShutDown()
+	healthMonitor := initHealthMonitor(podDeletes, newStateRecorder(), newPolicyStore(config), config)
+	go deletePod(podDeletes, healthMonitor, clientset, newRestartBudget(time.Minute), config)
+
+	expected := map[string]string{"default": actionDelete, "stuck": actionForceDelete, "protected": actionEvict}
+	for namespace := range expected {
+		markForDeletion(t, healthMonitor, apiserver.PodIdentifier{Name: "testPod", Namespace: namespace})
+	}
+
+	for namespace, action := range expected {
+		podIdentifier := apiserver.PodIdentifier{Name: "testPod", Namespace: namespace}
+		assert.Eventually(func() bool {
+			return podHealthStatus(healthMonitor, podIdentifier).IsDeleted
+		}, time.Second, 10*time.Millisecond)
+		assert.Equal(action, podHealthStatus(healthMonitor, podIdentifier).RemediationAction)
+	}
+	assert.Equal(uint32(2), podHealthStatus(healthMonitor, apiserver.PodIdentifier{Name: "testPod", Namespace: "protected"}).DeleteAttempts)
+
+	l, _ := clientset.CoreV1().Pods("").List(metav1.ListOptions{})
+	assert.Empty(l.Items)
+}
+
+func TestLeaderElection(t *testing.T) {
+	assert := assert.New(t)
+
+	clientset := fake.NewSimpleClientset(
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "monitor-a", Namespace: "longhorn-addon"},
+			Status:     v1.PodStatus{PodIP: "127.0.0.1"},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "monitor-b", Namespace: "longhorn-addon"},
+			Status:     v1.PodStatus{PodIP: "127.0.0.2"},
+		},
+	)
+
+	leaderConfig := &MonitorConfig{RestartThreshold: 3, LeaderElect: true, LeaseName: "longhorn-monitor", Namespace: "longhorn-addon", PodName: "monitor-a"}
+	leaderHealthMonitor := initHealthMonitor(workqueue.New(), newStateRecorder(), newPolicyStore(leaderConfig), leaderConfig)
+	leaderProxy := newLeaderProxy(clientset, leaderConfig, 0)
+	server := httptest.NewServer(initWebServer(leaderHealthMonitor, leaderProxy.Middleware))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	assert.NoError(err)
+	port, err := strconv.Atoi(serverURL.Port())
+	assert.NoError(err)
+
+	followerConfig := &MonitorConfig{RestartThreshold: 3, LeaderElect: true, LeaseName: "longhorn-monitor", Namespace: "longhorn-addon", PodName: "monitor-b"}
+	followerHealthMonitor := initHealthMonitor(workqueue.New(), newStateRecorder(), newPolicyStore(followerConfig), followerConfig)
+	followerProxy := newLeaderProxy(clientset, followerConfig, port)
+	e := initWebServer(followerHealthMonitor, followerProxy.Middleware)
+
+	q := make(url.Values)
+	q.Set("podName", "testPod")
+	q.Set("namespace", "default")
+	q.Set("isHealthy", "false")
+
+	// Without a leader, requests cannot be handled
+	result := testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+	assert.Equal(http.StatusServiceUnavailable, result.Code())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	restoring := make(chan struct{})
+	restored := make(chan struct{})
+	started := make(chan struct{})
+	go runLeaderElection(ctx, clientset, leaderConfig, leaderProxy, func() {
+		close(restoring)
+		<-restored
+	}, func(ctx context.Context) {
+		close(started)
+	})
+
+	select {
+	case <-restoring:
+	case <-time.After(5 * time.Second):
+		t.Fatal("monitor-a did not become the leader")
+	}
+
+	// Reports are not handled until the state is restored
+	result = testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, initWebServer(leaderHealthMonitor, leaderProxy.Middleware))
+	assert.Equal(http.StatusServiceUnavailable, result.Code())
+	close(restored)
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("monitor-a did not start after restoring the state")
+	}
+
+	go runLeaderElection(ctx, clientset, followerConfig, followerProxy, func() {
+		t.Error("monitor-b restored the state")
+	}, func(ctx context.Context) {
+		t.Error("monitor-b became the leader")
+	})
+
+	// The follower forwards reports to the leader
+	assert.Eventually(func() bool {
+		result := testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+		return result.Code() == http.StatusCreated
+	}, 5*time.Second, 10*time.Millisecond)
+
+	result = testutil.NewRequest().Get("/podHealth").Go(t, e)
+	var resultList []apiserver.PodHealth
+	err = result.UnmarshalBodyToObject(&resultList)
+	assert.NoError(err, "error unmarshaling response")
+	stripReports(resultList)
+	assert.Equal([]apiserver.PodHealth{{
+		ErrorCount: 1,
+		IsHealthy:  false,
+		PodName:    "testPod",
+		Namespace:  "default",
+	}}, resultList)
+
+	assert.Equal(1, len(recordedPods(leaderHealthMonitor)))
+	assert.Equal(0, len(recordedPods(followerHealthMonitor)))
+
+	lease, err := clientset.CoordinationV1().Leases("longhorn-addon").Get("longhorn-monitor", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal("monitor-a", *lease.Spec.HolderIdentity)
+}
+
+func TestLeaderProxy(t *testing.T) {
+	assert := assert.New(t)
+
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer leader.Close()
+
+	leaderURL, err := url.Parse(leader.URL)
+	assert.NoError(err)
+	port, err := strconv.Atoi(leaderURL.Port())
+	assert.NoError(err)
+
+	clientset := fake.NewSimpleClientset(
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "monitor-a", Namespace: "longhorn-addon"},
+		},
+	)
+	config := &MonitorConfig{RestartThreshold: 3, LeaderElect: true, Namespace: "longhorn-addon", PodName: "monitor-b"}
+	healthMonitor := initHealthMonitor(workqueue.New(), newStateRecorder(), newPolicyStore(config), config)
+	proxy := newLeaderProxy(clientset, config, port)
+	e := initWebServer(healthMonitor, proxy.Middleware)
+
+	post := func() int {
+		q := make(url.Values)
+		q.Set("podName", "testPod")
+		q.Set("namespace", "default")
+		q.Set("isHealthy", "true")
+		return testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e).Code()
+	}
+
+	// The pod of the leader has no IP yet
+	proxy.newLeader("monitor-a")
+	assert.Equal(http.StatusServiceUnavailable, post())
+
+	// The address is resolved once the pod has an IP
+	pod, err := clientset.CoreV1().Pods("longhorn-addon").Get("monitor-a", metav1.GetOptions{})
+	assert.NoError(err)
+	pod.Status.PodIP = "127.0.0.1"
+	_, err = clientset.CoreV1().Pods("longhorn-addon").UpdateStatus(pod)
+	assert.NoError(err)
+	assert.Equal(http.StatusCreated, post())
+
+	// Requests are not forwarded to the previous leader once this replica is
+	// elected
+	proxy.newLeader("monitor-b")
+	assert.Equal(http.StatusServiceUnavailable, post())
+	proxy.startedLeading()
+	assert.Equal(http.StatusCreated, post())
+}
+
+func TestEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	isController := true
+	clientset := fake.NewSimpleClientset(
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "web-0",
+				Namespace:       "default",
+				OwnerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: "web", Controller: &isController}},
+			},
+		},
+	)
+
+	podDeletes := workqueue.New()
+	config := &MonitorConfig{RestartThreshold: 2}
+	healthMonitor := initHealthMonitor(podDeletes, apiserver.NewMemoryStateStore(), newPolicyStore(config), config)
+	e := initWebServer(healthMonitor)
+
+	recorder := record.NewFakeRecorder(100)
+	go recordEvents(watchEvents(healthMonitor), clientset, recorder)
+
+	// Events are recorded for the pod and its owner
+	nextEvent := func(expected string) {
+		for i := 0; i < 2; i++ {
+			select {
+			case event := <-recorder.Events:
+				assert.Equal(expected, event)
+			case <-time.After(time.Second):
+				t.Fatalf("Event %q was not recorded", expected)
+			}
+		}
+	}
+
+	q := make(url.Values)
+	q.Set("podName", "web-0")
+	q.Set("namespace", "default")
+	q.Set("volumeName", "data")
+	q.Set("isHealthy", "true")
+
+	result := testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+	assert.Equal(http.StatusCreated, result.Code())
+
+	q.Set("isHealthy", "false")
+	result = testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+	assert.Equal(http.StatusOK, result.Code())
+	nextEvent("Warning VolumeUnhealthy Volume data of pod web-0 is unhealthy (error count 1, reason unknown)")
+
+	q.Set("isHealthy", "true")
+	result = testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+	assert.Equal(http.StatusOK, result.Code())
+	nextEvent("Normal VolumeRecovered Volume data of pod web-0 recovered (error count 1)")
+
+	q.Set("isHealthy", "false")
+	for i := 0; i < 2; i++ {
+		result = testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+		assert.Equal(http.StatusOK, result.Code())
+	}
+	nextEvent("Warning VolumeUnhealthy Volume data of pod web-0 is unhealthy (error count 1, reason unknown)")
+	nextEvent("Warning RestartThresholdReached Volume data of pod web-0 reached the error threshold (error count 2), pod will be restarted")
+
+	podIdentifier := apiserver.PodIdentifier{Name: "web-0", Namespace: "default"}
+	assert.Equal(podIdentifier, nextPodDelete(podDeletes))
+
+	healthMonitor.RecordDeleteResult(apiserver.PodDeleteResult{
+		Identifier: podIdentifier,
+		Action:     actionEvict,
+		Error:      "Too many requests",
+		NextRetry:  time.Now().Add(time.Minute),
+	})
+	nextEvent("Warning PodRestartFailed Restarting pod web-0 with action evict failed because volume data is unhealthy (error count 2): Too many requests")
+
+	healthMonitor.RecordDeleteResult(apiserver.PodDeleteResult{
+		Identifier: podIdentifier,
+		Action:     actionEvict,
+		Success:    true,
+	})
+	nextEvent("Normal PodRestarted Pod web-0 was restarted with action evict because volume data is unhealthy (error count 2)")
+
+	healthMonitor.RecordDryRun(podIdentifier, actionEvict)
+	nextEvent("Normal WouldRestart Volume data of pod web-0 reached the error threshold (error count 2), pod would have been restarted with action evict (dry run)")
+
+	result = testutil.NewRequest().Get("/podHealth").Go(t, e)
+	var resultList []apiserver.PodHealth
+	err := result.UnmarshalBodyToObject(&resultList)
+	assert.NoError(err, "error unmarshaling response")
+	assert.Equal(1, len(resultList))
+	unknown := apiserver.ReasonUnknown
+	assert.Equal(&[]apiserver.VolumeHealth{{VolumeName: "data", IsHealthy: false, ErrorCount: 2, Reason: &unknown}}, resultList[0].Volumes)
+}
+
+func TestDryRun(t *testing.T) {
+	assert := assert.New(t)
+
+	clientset := fake.NewSimpleClientset(
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "testPod", Namespace: "default"},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "testPod", Namespace: "staging"},
+		},
+	)
+	addEvictionReactor(clientset)
+
+	config := &MonitorConfig{
+		RestartThreshold:  2,
+		RemediationAction: actionEvict,
+		DeleteMaxAttempts: 1,
+		DryRunNamespaces:  map[string]bool{"staging": true},
+	}
+	podDeletes := initDeleteQueue(config)
+	defer podDeletes.ShutDown()
+	healthMonitor := initHealthMonitor(podDeletes, newStateRecorder(), newPolicyStore(config), config)
+	e := initWebServer(healthMonitor)
+	go deletePod(podDeletes, healthMonitor, clientset, newRestartBudget(time.Minute), config)
+
+	recorder := record.NewFakeRecorder(100)
+	go recordEvents(watchEvents(healthMonitor), clientset, recorder)
+
+	staging := apiserver.PodIdentifier{Name: "testPod", Namespace: "staging"}
+	dryRunRestarts := promtestutil.ToFloat64(apiserver.DryRunRestarts.WithLabelValues("staging"))
+
+	post := func(namespace string, isHealthy bool) int {
+		q := make(url.Values)
+		q.Set("podName", "testPod")
+		q.Set("namespace", namespace)
+		q.Set("isHealthy", strconv.FormatBool(isHealthy))
+		return testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e).Code()
+	}
+
+	for _, namespace := range []string{"default", "staging"} {
+		assert.Equal(http.StatusCreated, post(namespace, false))
+		assert.Equal(http.StatusOK, post(namespace, false))
+	}
+
+	assert.Eventually(func() bool {
+		return podHealthStatus(healthMonitor, staging).WouldRestart
+	}, time.Second, 10*time.Millisecond)
+
+	healthStatus := podHealthStatus(healthMonitor, staging)
+	assert.False(healthStatus.IsDeleted)
+	assert.False(healthStatus.IsDeletePending)
+	assert.Equal(actionEvict, healthStatus.RemediationAction)
+	assert.Equal(dryRunRestarts+1, promtestutil.ToFloat64(apiserver.DryRunRestarts.WithLabelValues("staging")))
+
+	assert.Eventually(func() bool {
+		return podHealthStatus(healthMonitor, apiserver.PodIdentifier{Name: "testPod", Namespace: "default"}).IsDeleted
+	}, time.Second, 10*time.Millisecond)
+
+	// Only the pod that is really restarted is announced as such
+	reasons := make(map[string]int)
+	for done := false; !done; {
+		select {
+		case event := <-recorder.Events:
+			reasons[strings.Fields(event)[1]]++
+		case <-time.After(200 * time.Millisecond):
+			done = true
+		}
+	}
+	assert.Equal(1, reasons["RestartThresholdReached"])
+	assert.Equal(1, reasons["WouldRestart"])
+
+	// The pod keeps reporting unhealthy without being queued again
+	assert.Equal(http.StatusOK, post("staging", false))
+	assert.Equal(uint32(3), podHealthStatus(healthMonitor, staging).ErrorCount)
+	assert.Equal(0, podDeletes.Len())
+
+	result := testutil.NewRequest().Get("/podHealth").Go(t, e)
+	var resultList []apiserver.PodHealth
+	err := result.UnmarshalBodyToObject(&resultList)
+	assert.NoError(err, "error unmarshaling response")
+	for _, podHealth := range resultList {
+		assert.Equal(podHealth.Namespace == "staging", podHealth.WouldRestart)
+	}
+
+	// Reporting healthy clears the dry-run state
+	assert.Equal(http.StatusOK, post("staging", true))
+	assert.False(podHealthStatus(healthMonitor, staging).WouldRestart)
+
+	l, _ := clientset.CoreV1().Pods("").List(metav1.ListOptions{})
+	assert.Equal(1, len(l.Items))
+	assert.Equal("staging", l.Items[0].GetNamespace())
+}
+
+func newPolicy(name string, namespace string, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "longhorn-monitor.der-fetzer.de/v1alpha1",
+		"kind":       "LonghornMonitorPolicy",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": namespace,
+		},
+		"spec": spec,
+	}}
+}
+
+func TestPolicies(t *testing.T) {
+	assert := assert.New(t)
+
+	clientset := fake.NewSimpleClientset(
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "db-0", Namespace: "default", Labels: map[string]string{"app": "db"}},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "db-1",
+				Namespace: "default",
+				Labels:    map[string]string{"app": "db"},
+				Annotations: map[string]string{
+					"der-fetzer.de/longhorn-monitor.threshold": "2",
+					"der-fetzer.de/longhorn-monitor.action":    actionEvict,
+				},
+			},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "cache-0",
+				Namespace:   "default",
+				Labels:      map[string]string{"app": "cache"},
+				Annotations: map[string]string{"der-fetzer.de/longhorn-monitor.threshold": "often"},
+			},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default", Labels: map[string]string{"app": "web"}},
+		},
+	)
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		newPolicy("defaults", "default", map[string]interface{}{
+			"threshold":       int64(5),
+			"cooldownSeconds": int64(60),
+		}),
+		newPolicy("databases", "default", map[string]interface{}{
+			"selector": map[string]interface{}{
+				"matchLabels": map[string]interface{}{"app": "db"},
+			},
+			"threshold":             int64(10),
+			"action":                actionDelete,
+			"maxConcurrentRestarts": int64(2),
+			"dryRun":                true,
+		}),
+		newPolicy("caches", "default", map[string]interface{}{
+			"selector": map[string]interface{}{
+				"matchExpressions": []interface{}{
+					map[string]interface{}{"key": "app", "operator": "In", "values": []interface{}{"cache"}},
+				},
+			},
+			"action": apiserver.ActionNone,
+		}),
+	)
+
+	config := &MonitorConfig{RestartThreshold: 3, RemediationAction: actionEvict, MaxRestarts: 1}
+	policies := newPolicyStore(config)
+	podDeletes := workqueue.New()
+	healthMonitor := initHealthMonitor(podDeletes, newStateRecorder(), policies, config)
+	e := initWebServer(healthMonitor)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	policies.setPods(initPodInformer(clientset, healthMonitor, stopCh))
+	policies.watch(dynamicClient, stopCh)
+
+	assert.Eventually(func() bool {
+		return policies.resolve(apiserver.PodIdentifier{Name: "db-0", Namespace: "default"}).Name != ""
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(apiserver.Policy{
+		Name:                  "databases",
+		Threshold:             10,
+		Action:                actionDelete,
+		MaxConcurrentRestarts: 2,
+		DryRun:                true,
+	}, policies.resolve(apiserver.PodIdentifier{Name: "db-0", Namespace: "default"}))
+
+	// The annotations of the pod override its policy
+	assert.Equal(apiserver.Policy{
+		Name:                  "databases",
+		Threshold:             2,
+		Action:                actionEvict,
+		MaxConcurrentRestarts: 2,
+		DryRun:                true,
+	}, policies.resolve(apiserver.PodIdentifier{Name: "db-1", Namespace: "default"}))
+
+	assert.Equal(apiserver.Policy{
+		Name:                  "caches",
+		Threshold:             3,
+		Action:                apiserver.ActionNone,
+		MaxConcurrentRestarts: 1,
+	}, policies.resolve(apiserver.PodIdentifier{Name: "cache-0", Namespace: "default"}))
+
+	assert.Equal(apiserver.Policy{
+		Name:                  "defaults",
+		Threshold:             5,
+		Cooldown:              time.Minute,
+		Action:                actionEvict,
+		MaxConcurrentRestarts: 1,
+	}, policies.resolve(apiserver.PodIdentifier{Name: "web-0", Namespace: "default"}))
+
+	// Without policies in the namespace the global configuration applies
+	assert.Equal(apiserver.Policy{
+		Threshold:             3,
+		Action:                actionEvict,
+		MaxConcurrentRestarts: 1,
+	}, policies.resolve(apiserver.PodIdentifier{Name: "web-0", Namespace: "other"}))
+
+	post := func(podName string) int {
+		q := make(url.Values)
+		q.Set("podName", podName)
+		q.Set("namespace", "default")
+		q.Set("isHealthy", "false")
+		return testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e).Code()
+	}
+
+	// The threshold of the policy applies instead of the global one
+	for i := 0; i < 4; i++ {
+		post("web-0")
+	}
+	assert.Equal(0, podDeletes.Len())
+	post("web-0")
+	assert.Equal(apiserver.PodIdentifier{Name: "web-0", Namespace: "default"}, nextPodDelete(podDeletes))
+
+	// Pods of a policy without action are never restarted
+	for i := 0; i < 5; i++ {
+		post("cache-0")
+	}
+	assert.Equal(0, podDeletes.Len())
+	assert.Equal(uint32(5), podHealthStatus(healthMonitor, apiserver.PodIdentifier{Name: "cache-0", Namespace: "default"}).ErrorCount)
+
+	// The cooldown of a policy delays the next restart of the owner
+	budget := newRestartBudget(time.Hour)
+	now := time.Now()
+	assert.True(budget.acquire("StatefulSet/default/db", now, 0, time.Minute))
+	assert.True(budget.complete("StatefulSet/default/db", now.Add(time.Second)))
+	assert.False(budget.acquire("StatefulSet/default/db", now.Add(30*time.Second), 0, time.Minute))
+	assert.True(budget.acquire("StatefulSet/default/db", now.Add(61*time.Second), 0, time.Minute))
+}
+
+func TestPendingDeletionWaitsForPolicies(t *testing.T) {
+	assert := assert.New(t)
+
+	// The deletion was queued by the previous leader before the policy was
+	// switched to dry-run mode
+	db := apiserver.PodIdentifier{Name: "db-0", Namespace: "default"}
+	store := newStateRecorder()
+	assert.NoError(store.Save(map[apiserver.PodIdentifier]*apiserver.HealthStatus{
+		db: {ErrorCount: 3, IsDeletePending: true},
+	}))
+
+	clientset := fake.NewSimpleClientset(
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "db-0", Namespace: "default", Labels: map[string]string{"app": "db"}},
+		},
+	)
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		newPolicy("databases", "default", map[string]interface{}{
+			"dryRun": true,
+		}),
+	)
+	// A slow API server delays the sync of the policies
+	dynamicClient.PrependReactor("list", "longhornmonitorpolicies", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		time.Sleep(200 * time.Millisecond)
+		return false, nil, nil
+	})
+
+	config := &MonitorConfig{
+		RestartThreshold:  3,
+		RemediationAction: actionDelete,
+		DeleteMaxAttempts: 1,
+		Interval:          60,
+		WatchPods:         true,
+		WatchPolicies:     true,
+	}
+	policies := newPolicyStore(config)
+	podDeletes := initDeleteQueue(config)
+	defer podDeletes.ShutDown()
+	healthMonitor := initHealthMonitor(podDeletes, store, policies, config)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	startRemediation(healthMonitor, podDeletes, policies, clientset, dynamicClient, config, stopCh)
+
+	assert.Eventually(func() bool {
+		return podHealthStatus(healthMonitor, db).WouldRestart
+	}, time.Second, 10*time.Millisecond)
+
+	_, err := clientset.CoreV1().Pods("default").Get("db-0", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.False(podHealthStatus(healthMonitor, db).IsDeleted)
+}
+
+func TestPoliciesWithoutCRD(t *testing.T) {
+	assert := assert.New(t)
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	dynamicClient.PrependReactor("list", "longhornmonitorpolicies", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewNotFound(policyResource.GroupResource(), "")
+	})
+
+	config := &MonitorConfig{RestartThreshold: 3, RemediationAction: actionEvict, MaxRestarts: 1}
+	policies := newPolicyStore(config)
+	policies.syncTimeout = 100 * time.Millisecond
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	// The policies never sync, which does not block the monitor
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		policies.watch(dynamicClient, stopCh)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting for the policies blocked")
+	}
+
+	assert.Equal(apiserver.Policy{
+		Threshold:             3,
+		Action:                actionEvict,
+		MaxConcurrentRestarts: 1,
+	}, policies.resolve(apiserver.PodIdentifier{Name: "web-0", Namespace: "default"}))
+}
+
+func TestVolumes(t *testing.T) {
+	assert := assert.New(t)
+
+	podDeletes := workqueue.New()
+	config := &MonitorConfig{RestartThreshold: 3}
+	healthMonitor := initHealthMonitor(podDeletes, apiserver.NewMemoryStateStore(), newPolicyStore(config), config)
+	e := initWebServer(healthMonitor)
+
+	var events []apiserver.HealthEvent
+	healthMonitor.AddListener(func(event apiserver.HealthEvent) {
+		events = append(events, event)
+	})
+
+	post := func(volumeName string, isHealthy bool) int {
+		q := make(url.Values)
+		q.Set("podName", "db-0")
+		q.Set("namespace", "default")
+		q.Set("volumeName", volumeName)
+		q.Set("isHealthy", strconv.FormatBool(isHealthy))
+		return testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e).Code()
+	}
+
+	getHealth := func() apiserver.PodHealth {
+		result := testutil.NewRequest().Get("/podHealth").Go(t, e)
+		var resultList []apiserver.PodHealth
+		err := result.UnmarshalBodyToObject(&resultList)
+		assert.NoError(err, "error unmarshaling response")
+		assert.Equal(1, len(resultList))
+		return resultList[0]
+	}
+
+	assert.Equal(http.StatusCreated, post("wal", true))
+	assert.Equal(http.StatusOK, post("data", false))
+	assert.Equal(http.StatusOK, post("wal", true))
+	assert.Equal(http.StatusOK, post("data", false))
+	assert.Equal(http.StatusOK, post("wal", false))
+
+	// The pod is unhealthy if any volume is
+	podHealth := getHealth()
+	assert.False(podHealth.IsHealthy)
+	assert.Equal(int32(2), podHealth.ErrorCount)
+	unknown := apiserver.ReasonUnknown
+	assert.Equal(&[]apiserver.VolumeHealth{
+		{VolumeName: "data", IsHealthy: false, ErrorCount: 2, Reason: &unknown},
+		{VolumeName: "wal", IsHealthy: false, ErrorCount: 1, Reason: &unknown},
+	}, podHealth.Volumes)
+
+	// The pod recovers once all volumes are healthy
+	assert.Equal(http.StatusOK, post("data", true))
+	assert.Equal(int32(1), getHealth().ErrorCount)
+	assert.Equal(http.StatusOK, post("wal", true))
+	assert.True(getHealth().IsHealthy)
+
+	// A single volume reaching the threshold restarts the pod
+	for i := 0; i < 2; i++ {
+		assert.Equal(http.StatusOK, post("data", false))
+		assert.Equal(http.StatusOK, post("wal", true))
+	}
+	assert.Equal(http.StatusOK, post("data", false))
+	assert.Equal(apiserver.PodIdentifier{Name: "db-0", Namespace: "default"}, nextPodDelete(podDeletes))
+
+	var summary []string
+	for _, event := range events {
+		summary = append(summary, fmt.Sprintf("%s %s %d", event.Type, event.VolumeName, event.ErrorCount))
+	}
+	assert.Equal([]string{
+		"Healthy wal 0",
+		"Unhealthy data 1",
+		"Unhealthy wal 1",
+		"Recovered wal 1",
+		"Unhealthy data 1",
+		"ThresholdReached data 3",
+	}, summary)
+}
+
+func TestFailureReasons(t *testing.T) {
+	assert := assert.New(t)
+
+	podDeletes := workqueue.New()
+	config := &MonitorConfig{RestartThreshold: 2}
+	healthMonitor := initHealthMonitor(podDeletes, apiserver.NewMemoryStateStore(), newPolicyStore(config), config)
+	e := initWebServer(healthMonitor)
+
+	post := func(volumeName string, reason apiserver.FailureReason) int {
+		q := make(url.Values)
+		q.Set("podName", "db-0")
+		q.Set("namespace", "default")
+		q.Set("volumeName", volumeName)
+		q.Set("isHealthy", strconv.FormatBool(reason == ""))
+		body := apiserver.ProbeResult{}
+		if reason != "" {
+			body.Reason = &reason
+		}
+		return testutil.NewRequest().Post("/podHealth?"+q.Encode()).WithJsonBody(body).Go(t, e).Code()
+	}
+
+	// A full volume is unhealthy, but does not restart the pod
+	assert.Equal(http.StatusCreated, post("data", apiserver.ReasonDiskFull))
+	for i := 0; i < 3; i++ {
+		assert.Equal(http.StatusOK, post("data", apiserver.ReasonDiskFull))
+	}
+	var resultList []apiserver.PodHealth
+	err := testutil.NewRequest().Get("/podHealth").Go(t, e).UnmarshalBodyToObject(&resultList)
+	assert.NoError(err, "error unmarshaling response")
+	assert.Equal(1, len(resultList))
+	podHealth := resultList[0]
+	assert.False(podHealth.IsHealthy)
+	assert.Equal(int32(0), podHealth.ErrorCount)
+	diskFull := apiserver.ReasonDiskFull
+	assert.Equal(&[]apiserver.VolumeHealth{
+		{VolumeName: "data", IsHealthy: false, ErrorCount: 4, Reason: &diskFull},
+	}, podHealth.Volumes)
+	assert.Equal(0, podDeletes.Len())
+
+	// A read-only volume restarts the pod
+	assert.Equal(http.StatusOK, post("data", apiserver.ReasonReadOnly))
+	assert.Equal(apiserver.PodIdentifier{Name: "db-0", Namespace: "default"}, nextPodDelete(podDeletes))
+}
+
+func TestReports(t *testing.T) {
+	assert := assert.New(t)
+
+	podDeletes := workqueue.New()
+	config := &MonitorConfig{RestartThreshold: 10, ReportHistory: 3}
+	healthMonitor := initHealthMonitor(podDeletes, apiserver.NewMemoryStateStore(), newPolicyStore(config), config)
+	e := initWebServer(healthMonitor)
+
+	post := func(isHealthy bool, body interface{}) int {
+		q := make(url.Values)
+		q.Set("podName", "db-0")
+		q.Set("namespace", "default")
+		q.Set("volumeName", "data")
+		q.Set("isHealthy", strconv.FormatBool(isHealthy))
+		request := testutil.NewRequest().Post("/podHealth?" + q.Encode())
+		if body != nil {
+			request = request.WithJsonBody(body)
+		}
+		return request.Go(t, e).Code()
+	}
+
+	int64Ptr := func(i int64) *int64 { return &i }
+	stringPtr := func(s string) *string { return &s }
+
+	// Reports without body are still accepted
+	assert.Equal(http.StatusCreated, post(true, nil))
+	for i := int64(1); i <= 3; i++ {
+		assert.Equal(http.StatusOK, post(true, apiserver.ProbeResult{LatencyMs: int64Ptr(i), BytesWritten: int64Ptr(4096)}))
+	}
+	ioError := apiserver.ReasonIOError
+	assert.Equal(http.StatusOK, post(false, apiserver.ProbeResult{
+		Reason:    &ioError,
+		Message:   stringPtr("could not write probe file: input/output error"),
+		LatencyMs: int64Ptr(1500),
+	}))
+	assert.Equal(http.StatusBadRequest, post(false, "not a probe result"))
+
+	var resultList []apiserver.PodHealth
+	err := testutil.NewRequest().Get("/podHealth").Go(t, e).UnmarshalBodyToObject(&resultList)
+	assert.NoError(err, "error unmarshaling response")
+	assert.Equal(1, len(resultList))
+	if !assert.NotNil(resultList[0].Reports) {
+		return
+	}
+
+	// Only the last reports are kept, oldest first
+	reports := *resultList[0].Reports
+	assert.Equal(3, len(reports))
+	for _, report := range reports {
+		assert.False(report.Time.IsZero())
+		assert.Equal(stringPtr("data"), report.VolumeName)
+	}
+	assert.True(reports[0].IsHealthy)
+	assert.Equal(int64Ptr(2), reports[0].LatencyMs)
+	assert.Equal(int64Ptr(4096), reports[0].BytesWritten)
+	assert.Nil(reports[0].Reason)
+	assert.False(reports[2].IsHealthy)
+	assert.Equal(&ioError, reports[2].Reason)
+	assert.Equal(stringPtr("could not write probe file: input/output error"), reports[2].Message)
+	assert.Equal(int64Ptr(1500), reports[2].LatencyMs)
+	assert.Nil(reports[2].BytesWritten)
+}
+
+func TestTokenAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	clientset := fake.NewSimpleClientset()
+	var reviews int
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		switch review.Spec.Token {
+		case "web-0-token":
+			review.Status = authenticationv1.TokenReviewStatus{
+				Authenticated: true,
+				Audiences:     review.Spec.Audiences,
+				User: authenticationv1.UserInfo{
+					Username: "system:serviceaccount:default:web",
+					Extra: map[string]authenticationv1.ExtraValue{
+						podNameExtra: {"web-0"},
+						podUIDExtra:  {"uid-0"},
+					},
+				},
+			}
+		case "other-audience-token":
+			review.Status = authenticationv1.TokenReviewStatus{
+				Authenticated: true,
+				Audiences:     []string{"kubernetes"},
+				User: authenticationv1.UserInfo{
+					Username: "system:serviceaccount:default:web",
+					Extra:    map[string]authenticationv1.ExtraValue{podNameExtra: {"web-0"}},
+				},
+			}
+		case "unavailable":
+			return true, review, errors.NewServiceUnavailable("unavailable")
+		}
+		return true, review, nil
+	})
+
+	config := &MonitorConfig{RestartThreshold: 3, TokenAudience: "longhorn-monitor"}
+	healthMonitor := initHealthMonitor(workqueue.New(), apiserver.NewMemoryStateStore(), newPolicyStore(config), config)
+	e := initWebServer(healthMonitor, newTokenAuth(clientset, config).Middleware)
+
+	post := func(token, podName, podUID string) int {
+		q := make(url.Values)
+		q.Set("podName", podName)
+		q.Set("namespace", "default")
+		q.Set("isHealthy", "false")
+		if podUID != "" {
+			q.Set("podUid", podUID)
+		}
+		request := testutil.NewRequest().Post("/podHealth?" + q.Encode())
+		if token != "" {
+			request = request.WithHeader(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		return request.Go(t, e).Code()
+	}
+
+	assert.Equal(http.StatusUnauthorized, post("", "web-0", ""))
+	assert.Equal(http.StatusUnauthorized, post("invalid-token", "web-0", ""))
+	assert.Equal(http.StatusUnauthorized, post("other-audience-token", "web-0", ""))
+	assert.Equal(http.StatusServiceUnavailable, post("unavailable", "web-0", ""))
+
+	// The token only authenticates reports of its own pod
+	assert.Equal(http.StatusForbidden, post("web-0-token", "web-1", ""))
+	assert.Equal(http.StatusForbidden, post("web-0-token", "web-0", "uid-1"))
+	assert.Equal(http.StatusCreated, post("web-0-token", "web-0", "uid-0"))
+	assert.Equal(http.StatusOK, post("web-0-token", "web-0", ""))
+
+	// Reviews of valid tokens are cached
+	assert.Equal(4, reviews)
+
+	// Reading the entries does not require a token
+	assert.Equal(http.StatusOK, testutil.NewRequest().Get("/podHealth").Go(t, e).Code())
+
+	q := make(url.Values)
+	q.Set("podName", "web-0")
+	q.Set("namespace", "default")
+	assert.Equal(http.StatusUnauthorized, testutil.NewRequest().Delete("/podHealth?"+q.Encode()).Go(t, e).Code())
+
+	// While tokens are optional, reports of health checks without token are
+	// accepted, but invalid tokens are still rejected
+	config.TokenAuthOptional = true
+	e = initWebServer(healthMonitor, newTokenAuth(clientset, config).Middleware)
+	unauthenticated := promtestutil.ToFloat64(apiserver.UnauthenticatedReports.WithLabelValues("default"))
+	assert.Equal(http.StatusCreated, post("", "web-1", ""))
+	assert.Equal(unauthenticated+1, promtestutil.ToFloat64(apiserver.UnauthenticatedReports.WithLabelValues("default")))
+	assert.Equal(http.StatusUnauthorized, post("invalid-token", "web-1", ""))
+	assert.Equal(http.StatusForbidden, post("web-0-token", "web-1", ""))
+	assert.Equal(http.StatusUnauthorized, testutil.NewRequest().Delete("/podHealth?"+q.Encode()).Go(t, e).Code())
+	assert.Equal(http.StatusOK, testutil.NewRequest().Delete("/podHealth?"+q.Encode()).WithHeader(echo.HeaderAuthorization, "Bearer web-0-token").Go(t, e).Code())
+}
+
+// writeTestCert writes a certificate signed by the parent, or a self-signed CA
+// if parent is nil, and its key to the directory.
+func writeTestCert(t *testing.T, dir, name string, parent *tls.Certificate) (*tls.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cert, certFile, keyFile
+}
+
+func TestTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "tls")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	ca, caFile, _ := writeTestCert(t, dir, "ca", nil)
+	cert, certFile, keyFile := writeTestCert(t, dir, "monitor", ca)
+	client, _, _ := writeTestCert(t, dir, "client", ca)
+	other, _, _ := writeTestCert(t, dir, "other", nil)
+
+	certs, err := newCertReloader(certFile, keyFile, caFile)
+	assert.NoError(err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.TLS = certs.serverConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(ca.Leaf)
+
+	get := func(config *tls.Config) error {
+		transport := &http.Transport{TLSClientConfig: config}
+		defer transport.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	// Clients have to present a certificate signed by the client CA
+	assert.NoError(get(&tls.Config{RootCAs: rootCAs, Certificates: []tls.Certificate{*client}}))
+	assert.Error(get(&tls.Config{RootCAs: rootCAs}))
+	assert.Error(get(&tls.Config{RootCAs: rootCAs, Certificates: []tls.Certificate{*other}}))
+
+	// Followers verify that the leader presents the same certificate
+	assert.NoError(get(certs.proxyConfig()))
+	otherCerts, err := newCertReloader(filepath.Join(dir, "other.pem"), filepath.Join(dir, "other-key.pem"), "")
+	assert.NoError(err)
+	assert.Error(get(otherCerts.proxyConfig()))
+
+	// Unchanged files are not reloaded
+	reloaded, err := certs.reload()
+	assert.NoError(err)
+	assert.False(reloaded)
+
+	// Rotated certificates are served without restart
+	rotated, _, _ := writeTestCert(t, dir, "monitor", ca)
+	later := time.Now().Add(time.Minute)
+	assert.NoError(os.Chtimes(certFile, later, later))
+	assert.NoError(os.Chtimes(keyFile, later, later))
+
+	reloaded, err = certs.reload()
+	assert.NoError(err)
+	assert.True(reloaded)
+
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{RootCAs: rootCAs, Certificates: []tls.Certificate{*client}})
+	assert.NoError(err)
+	if err == nil {
+		assert.Equal(rotated.Certificate[0], conn.ConnectionState().PeerCertificates[0].Raw)
+		assert.NotEqual(cert.Certificate[0], conn.ConnectionState().PeerCertificates[0].Raw)
+		conn.Close()
+	}
+
+	// Invalid files keep the previous certificate
+	assert.NoError(ioutil.WriteFile(certFile, []byte("invalid"), 0600))
+	assert.NoError(os.Chtimes(certFile, later.Add(time.Minute), later.Add(time.Minute)))
+	_, err = certs.reload()
+	assert.Error(err)
+	assert.NoError(get(&tls.Config{RootCAs: rootCAs, Certificates: []tls.Certificate{*client}}))
+}
+
+func TestRateLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	clientset := fake.NewSimpleClientset(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "fast",
+			Namespace:   "default",
+			Annotations: map[string]string{"der-fetzer.de/longhorn-monitor.interval": "10"},
+		},
+	})
+
+	config := &MonitorConfig{RestartThreshold: 3, Interval: 60}
+	policies := newPolicyStore(config)
+	healthMonitor := initHealthMonitor(workqueue.New(), apiserver.NewMemoryStateStore(), policies, config)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	policies.setPods(initPodInformer(clientset, healthMonitor, stopCh))
+
+	// The interval of the pod is taken from its annotation
+	assert.Equal(10*time.Second, policies.interval(apiserver.PodIdentifier{Name: "fast", Namespace: "default"}))
+	assert.Equal(60*time.Second, policies.interval(apiserver.PodIdentifier{Name: "testPod", Namespace: "default"}))
+
+	limiter := newRateLimiter(0, 0, policies.interval)
+	e := initWebServer(healthMonitor, limiter.Global, limiter.PerPod)
+
+	report := func(podName, volumeName string) *testutil.CompletedRequest {
+		q := make(url.Values)
+		q.Set("podName", podName)
+		q.Set("namespace", "default")
+		q.Set("isHealthy", "true")
+		q.Set("volumeName", volumeName)
+		return testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+	}
+
+	assert.Equal(http.StatusCreated, report("testPod", "data").Code())
+
+	// Reports of a volume faster than half the interval are rejected
+	podLimited := promtestutil.ToFloat64(apiserver.RateLimitedReports.WithLabelValues("pod"))
+	result := report("testPod", "data")
+	assert.Equal(http.StatusTooManyRequests, result.Code())
+	assert.Equal("30", result.Recorder.Header().Get("Retry-After"))
+	assert.Equal(podLimited+1, promtestutil.ToFloat64(apiserver.RateLimitedReports.WithLabelValues("pod")))
+
+	// Other volumes and pods are not affected
+	assert.Equal(http.StatusOK, report("testPod", "logs").Code())
+	assert.Equal(http.StatusCreated, report("fast", "data").Code())
+
+	// Reading the entries is not limited
+	for i := 0; i < 3; i++ {
+		assert.Equal(http.StatusOK, testutil.NewRequest().Get("/podHealth").Go(t, e).Code())
+	}
+
+	key := reportKey{PodIdentifier: apiserver.PodIdentifier{Name: "fast", Namespace: "default"}, VolumeName: "data"}
+	now := time.Now()
+	assert.NotZero(limiter.reserve(key, now))
+	assert.Zero(limiter.reserve(key, now.Add(5*time.Second)))
+
+	// The global limit applies to all pods
+	globalLimited := promtestutil.ToFloat64(apiserver.RateLimitedReports.WithLabelValues("global"))
+	limiter = newRateLimiter(1, 1, policies.interval)
+	e = initWebServer(healthMonitor, limiter.Global, limiter.PerPod)
+	assert.Equal(http.StatusOK, report("testPod", "cache").Code())
+	assert.Equal(http.StatusServiceUnavailable, report("fast", "cache").Code())
+	assert.Equal(globalLimited+1, promtestutil.ToFloat64(apiserver.RateLimitedReports.WithLabelValues("global")))
+}
+
+// slowStateStore blocks saving until it is released.
+type slowStateStore struct {
+	apiserver.MemoryStateStore
+	release chan struct{}
+}
+
+func (s *slowStateStore) Save(pods map[apiserver.PodIdentifier]*apiserver.HealthStatus) error {
+	<-s.release
+	return nil
+}
+
+func TestSlowStateStore(t *testing.T) {
+	assert := assert.New(t)
+
+	store := &slowStateStore{release: make(chan struct{})}
+	defer close(store.release)
+
+	config := &MonitorConfig{RestartThreshold: 3}
+	healthMonitor := initHealthMonitor(workqueue.New(), store, newPolicyStore(config), config)
+	e := initWebServer(healthMonitor)
+
+	q := make(url.Values)
+	q.Set("podName", "testPod")
+	q.Set("namespace", "default")
+	q.Set("isHealthy", "false")
+
+	// A store that does not respond does not block the handlers
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+		}
+		testutil.NewRequest().Get("/podHealth").Go(t, e)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handlers blocked on the state store")
+	}
+
+	result := testutil.NewRequest().Get("/podHealth").Go(t, e)
+	var resultList []apiserver.PodHealth
+	err := result.UnmarshalBodyToObject(&resultList)
+	assert.NoError(err, "error unmarshaling response")
+	assert.Equal(1, len(resultList))
+	assert.Equal(int32(3), resultList[0].ErrorCount)
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	const (
+		pods       = 20
+		workers    = 8
+		iterations = 200
+		apiDelay   = time.Second
+	)
+
+	clientset := fake.NewSimpleClientset()
+	for i := 0; i < pods; i++ {
+		_, err := clientset.CoreV1().Pods("default").Create(&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod-%d", i), Namespace: "default"},
+		})
+		assert.NoError(err)
+	}
+
+	// Every call of the Kubernetes API takes a while
+	clientset.PrependReactor("*", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		time.Sleep(apiDelay)
+		return false, nil, nil
+	})
+
+	config := &MonitorConfig{RestartThreshold: 2, RemediationAction: actionDelete, MaxRestarts: pods, DeleteMaxAttempts: 3}
+	podDeletes := initDeleteQueue(config)
+	defer podDeletes.ShutDown()
+	healthMonitor := initHealthMonitor(podDeletes, newStateRecorder(), newPolicyStore(config), config)
+	e := initWebServer(healthMonitor)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	go deletePod(podDeletes, healthMonitor, clientset, newRestartBudget(time.Minute), config)
+	go recordEvents(watchEvents(healthMonitor), clientset, record.NewFakeRecorder(workers*iterations*2))
+	go func() {
+		podExists := func(podIdentifier apiserver.PodIdentifier) (bool, error) {
+			_, err := clientset.CoreV1().Pods(podIdentifier.Namespace).Get(podIdentifier.Name, metav1.GetOptions{})
+			return err == nil, err
+		}
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+				healthMonitor.ReapStale(time.Now(), func(apiserver.PodIdentifier) time.Duration { return time.Hour }, 0, 1, podExists)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	latencies := make(chan time.Duration, workers*iterations)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			random := mathrand.New(mathrand.NewSource(int64(w)))
+
+			for i := 0; i < iterations; i++ {
+				q := make(url.Values)
+				q.Set("podName", fmt.Sprintf("pod-%d", random.Intn(pods)))
+				q.Set("namespace", "default")
+
+				start := time.Now()
+				var result *testutil.CompletedRequest
+				switch random.Intn(4) {
+				case 0, 1:
+					q.Set("isHealthy", strconv.FormatBool(random.Intn(3) == 0))
+					q.Set("volumeName", fmt.Sprintf("volume-%d", random.Intn(2)))
+					result = testutil.NewRequest().Post("/podHealth?"+q.Encode()).Go(t, e)
+				case 2:
+					result = testutil.NewRequest().Get("/podHealth").Go(t, e)
+				case 3:
+					result = testutil.NewRequest().Delete("/podHealth?"+q.Encode()).Go(t, e)
+				}
+				latencies <- time.Since(start)
+
+				switch result.Code() {
+				case http.StatusOK, http.StatusCreated, http.StatusNotFound, http.StatusInternalServerError:
+				default:
+					t.Errorf("unexpected status code %d", result.Code())
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(latencies)
+
+	// No request waited for a call of the Kubernetes API
+	var slowest time.Duration
+	for latency := range latencies {
+		if latency > slowest {
+			slowest = latency
+		}
+	}
+	assert.Less(int64(slowest), int64(apiDelay/2), "slowest request took %s", slowest)
+
+	assert.LessOrEqual(len(recordedPods(healthMonitor)), pods)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/derfetzer/longhorn-monitor/monitor/apiserver"
+	"github.com/rs/zerolog/log"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var policyResource = schema.GroupVersionResource{
+	Group:    "longhorn-monitor.der-fetzer.de",
+	Version:  "v1alpha1",
+	Resource: "longhornmonitorpolicies",
+}
+
+// LonghornMonitorPolicy overrides the remediation of the pods in its namespace
+// that are matched by its selector. Fields that are not set fall back to the
+// global configuration.
+type LonghornMonitorPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec LonghornMonitorPolicySpec `json:"spec"`
+}
+
+type LonghornMonitorPolicySpec struct {
+	Selector              *metav1.LabelSelector `json:"selector,omitempty"`
+	Threshold             *uint32               `json:"threshold,omitempty"`
+	CooldownSeconds       *uint32               `json:"cooldownSeconds,omitempty"`
+	Action                *string               `json:"action,omitempty"`
+	MaxConcurrentRestarts *uint32               `json:"maxConcurrentRestarts,omitempty"`
+	DryRun                *bool                 `json:"dryRun,omitempty"`
+}
+
+const (
+	annotationPrefix    = "der-fetzer.de/longhorn-monitor."
+	thresholdAnnotation = annotationPrefix + "threshold"
+	actionAnnotation    = annotationPrefix + "action"
+	intervalAnnotation  = annotationPrefix + "interval"
+)
+
+// policyStore resolves the policy of pods from the LonghornMonitorPolicies in
+// their namespace. If several policies match a pod, policies with a selector
+// take precedence over policies without one and ties are broken by name. The
+// annotations of a pod take precedence over all policies.
+type policyStore struct {
+	config      *MonitorConfig
+	policies    cache.GenericLister
+	pods        corelisters.PodLister
+	syncTimeout time.Duration
+	lock        sync.RWMutex
+}
+
+func newPolicyStore(config *MonitorConfig) *policyStore {
+	return &policyStore{config: config, syncTimeout: 30 * time.Second}
+}
+
+// setPods sets the lister the labels and annotations of pods are taken from.
+// Without it, only policies without selector apply.
+func (s *policyStore) setPods(pods corelisters.PodLister) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pods = pods
+}
+
+// watch watches the policies in the cluster. It waits up to syncTimeout for
+// the informer to sync, as pending deletions restored from the state store
+// would otherwise be handled under the global configuration. The informer
+// never syncs if the CRD is not installed, so after the timeout the global
+// configuration applies until it does.
+func (s *policyStore) watch(dynamicClient dynamic.Interface, stopCh <-chan struct{}) {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 10*time.Minute)
+	informer := factory.ForResource(policyResource)
+	// The informer only starts with a registered event handler.
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{})
+	factory.Start(stopCh)
+
+	synced := func() (bool, error) {
+		return informer.Informer().HasSynced(), nil
+	}
+	if err := wait.PollImmediate(100*time.Millisecond, s.syncTimeout, synced); err != nil {
+		log.Error().
+			Dur("timeout", s.syncTimeout).
+			Msg("Could not sync policies, is the CRD installed? The global configuration applies until they are synced")
+		go func() {
+			if cache.WaitForCacheSync(stopCh, informer.Informer().HasSynced) {
+				log.Info().Msg("Synced policies")
+				s.setPolicies(informer.Lister())
+			}
+		}()
+		return
+	}
+	s.setPolicies(informer.Lister())
+}
+
+func (s *policyStore) setPolicies(policies cache.GenericLister) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.policies = policies
+}
+
+// resolve returns the effective policy of the pod.
+func (s *policyStore) resolve(podIdentifier apiserver.PodIdentifier) apiserver.Policy {
+	policy := apiserver.Policy{
+		Threshold:             s.config.RestartThreshold,
+		Action:                s.config.remediationActionFor(podIdentifier.Namespace),
+		MaxConcurrentRestarts: s.config.MaxRestarts,
+		DryRun:                s.config.dryRunFor(podIdentifier.Namespace),
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var pod *v1.Pod
+	if s.pods != nil {
+		pod, _ = s.pods.Pods(podIdentifier.Namespace).Get(podIdentifier.Name)
+	}
+
+	if s.policies != nil {
+		objs, err := s.policies.ByNamespace(podIdentifier.Namespace).List(labels.Everything())
+		if err == nil && len(objs) > 0 {
+			var podLabels labels.Set
+			if pod != nil {
+				podLabels = pod.Labels
+			}
+			if match := selectPolicy(objs, podLabels); match != nil {
+				match.Spec.apply(&policy)
+				policy.Name = match.Name
+			}
+		}
+	}
+
+	if pod != nil {
+		applyAnnotations(pod, &policy)
+	}
+	return policy
+}
+
+// interval returns the interval the pod reports its health in, which the
+// webhook configures from the annotation of the pod.
+func (s *policyStore) interval(podIdentifier apiserver.PodIdentifier) time.Duration {
+	interval := time.Duration(s.config.Interval) * time.Second
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.pods == nil {
+		return interval
+	}
+	pod, err := s.pods.Pods(podIdentifier.Namespace).Get(podIdentifier.Name)
+	if err != nil {
+		return interval
+	}
+	if v, p := pod.Annotations[intervalAnnotation]; p {
+		if conv, err := strconv.ParseUint(v, 10, 32); err == nil && conv > 0 {
+			return time.Duration(conv) * time.Second
+		}
+	}
+	return interval
+}
+
+// applyAnnotations overrides the policy with the annotations of the pod.
+// Invalid annotations are ignored, the webhook rejects them when injecting the
+// health check.
+func applyAnnotations(pod *v1.Pod, policy *apiserver.Policy) {
+	if v, p := pod.Annotations[thresholdAnnotation]; p {
+		if threshold, err := strconv.ParseUint(v, 10, 32); err == nil && threshold > 0 {
+			policy.Threshold = uint32(threshold)
+		} else {
+			log.Warn().
+				Interface("podIdentifier", podIdentifierOf(pod)).
+				Str("threshold", v).
+				Msg("Ignoring invalid threshold annotation of pod")
+		}
+	}
+	if v, p := pod.Annotations[actionAnnotation]; p {
+		if isValidAction(v) || v == apiserver.ActionNone {
+			policy.Action = v
+		} else {
+			log.Warn().
+				Interface("podIdentifier", podIdentifierOf(pod)).
+				Str("action", v).
+				Msg("Ignoring invalid action annotation of pod")
+		}
+	}
+}
+
+// selectPolicy returns the policy matching the labels with the highest precedence.
+func selectPolicy(objs []runtime.Object, podLabels labels.Set) *LonghornMonitorPolicy {
+	var matches []*LonghornMonitorPolicy
+	for _, obj := range objs {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+
+		policy := &LonghornMonitorPolicy{}
+		err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, policy)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("policy", u.GetName()).
+				Msg("Could not parse policy")
+			continue
+		}
+
+		// A missing selector matches all pods of the namespace.
+		selector := labels.Everything()
+		if policy.Spec.Selector != nil {
+			selector, err = metav1.LabelSelectorAsSelector(policy.Spec.Selector)
+			if err != nil {
+				log.Warn().
+					Err(err).
+					Str("policy", policy.Name).
+					Msg("Could not parse selector of policy")
+				continue
+			}
+		}
+		if selector.Matches(podLabels) {
+			matches = append(matches, policy)
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		iSelects, jSelects := !matches[i].Spec.hasEmptySelector(), !matches[j].Spec.hasEmptySelector()
+		if iSelects != jSelects {
+			return iSelects
+		}
+		return matches[i].Name < matches[j].Name
+	})
+	return matches[0]
+}
+
+func (spec *LonghornMonitorPolicySpec) hasEmptySelector() bool {
+	return spec.Selector == nil || (len(spec.Selector.MatchLabels) == 0 && len(spec.Selector.MatchExpressions) == 0)
+}
+
+// apply overrides the fields of the policy that are set in the spec.
+func (spec *LonghornMonitorPolicySpec) apply(policy *apiserver.Policy) {
+	if spec.Threshold != nil {
+		policy.Threshold = *spec.Threshold
+	}
+	if spec.CooldownSeconds != nil {
+		policy.Cooldown = time.Duration(*spec.CooldownSeconds) * time.Second
+	}
+	if spec.Action != nil {
+		if isValidAction(*spec.Action) || *spec.Action == apiserver.ActionNone {
+			policy.Action = *spec.Action
+		} else {
+			log.Warn().
+				Str("action", *spec.Action).
+				Msg("Ignoring invalid action of policy")
+		}
+	}
+	if spec.MaxConcurrentRestarts != nil {
+		policy.MaxConcurrentRestarts = *spec.MaxConcurrentRestarts
+	}
+	if spec.DryRun != nil {
+		policy.DryRun = *spec.DryRun
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/derfetzer/longhorn-monitor/monitor/apiserver"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// reportKey identifies the reports of a volume of a pod, each of which is sent
+// once per interval.
+type reportKey struct {
+	apiserver.PodIdentifier
+	VolumeName string
+}
+
+// rateLimiter protects the monitor from misconfigured or crash looping pods.
+// The global limit applies to all reports, while reports of a volume of a pod
+// are rejected if they arrive faster than half the interval of the pod, which
+// leaves room for probes taking longer than others.
+type rateLimiter struct {
+	global   *rate.Limiter
+	interval func(podIdentifier apiserver.PodIdentifier) time.Duration
+	next     map[reportKey]time.Time
+	pruned   time.Time
+	lock     sync.Mutex
+}
+
+// newRateLimiter returns a limiter of limit reports per second with bursts of
+// burst reports. A limit of 0 disables the global limit.
+func newRateLimiter(limit, burst uint32, interval func(podIdentifier apiserver.PodIdentifier) time.Duration) *rateLimiter {
+	global := rate.NewLimiter(rate.Inf, 0)
+	if limit > 0 {
+		global = rate.NewLimiter(rate.Limit(limit), int(burst))
+	}
+	return &rateLimiter{
+		global:   global,
+		interval: interval,
+		next:     make(map[reportKey]time.Time),
+	}
+}
+
+// Global rejects reports exceeding the global limit as unavailable, so that
+// the health checks retry them later. It has to come before the
+// authentication, whose token reviews are expensive.
+func (l *rateLimiter) Global(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		if ctx.Request().Method != http.MethodPost {
+			return next(ctx)
+		}
+
+		if !l.global.Allow() {
+			apiserver.RateLimitedReports.WithLabelValues("global").Inc()
+			return retryAfter(ctx, http.StatusServiceUnavailable, time.Second)
+		}
+		return next(ctx)
+	}
+}
+
+// PerPod rejects reports of a volume arriving faster than the interval of the
+// pod. Those are dropped by the health checks, as the next report follows
+// anyway. It has to come after the authentication, otherwise a pod could use
+// up the reports of another one.
+func (l *rateLimiter) PerPod(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		if ctx.Request().Method != http.MethodPost {
+			return next(ctx)
+		}
+
+		key := reportKey{
+			PodIdentifier: apiserver.PodIdentifier{
+				Name:      ctx.QueryParam("podName"),
+				Namespace: ctx.QueryParam("namespace"),
+			},
+			VolumeName: ctx.QueryParam("volumeName"),
+		}
+		if wait := l.reserve(key, time.Now()); wait > 0 {
+			log.Warn().
+				Interface("podIdentifier", key.PodIdentifier).
+				Str("volumeName", key.VolumeName).
+				Dur("wait", wait).
+				Msg("Rejected report of pod arriving faster than its interval")
+			apiserver.RateLimitedReports.WithLabelValues("pod").Inc()
+			return retryAfter(ctx, http.StatusTooManyRequests, wait)
+		}
+		return next(ctx)
+	}
+}
+
+// reserve accepts the report and returns 0, or returns how long it is too
+// early. Every minute, the entries that would not reject any report anymore
+// are removed.
+func (l *rateLimiter) reserve(key reportKey, now time.Time) time.Duration {
+	// The interval is resolved before taking the lock, as it may look up the
+	// annotations of the pod.
+	spacing := l.interval(key.PodIdentifier) / 2
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if next, p := l.next[key]; p && now.Before(next) {
+		return next.Sub(now)
+	}
+
+	if now.Sub(l.pruned) >= time.Minute {
+		for k, next := range l.next {
+			if !now.Before(next) {
+				delete(l.next, k)
+			}
+		}
+		l.pruned = now
+	}
+	l.next[key] = now.Add(spacing)
+	return 0
+}
+
+func retryAfter(ctx echo.Context, code int, wait time.Duration) error {
+	seconds := int(math.Ceil(wait.Seconds()))
+	ctx.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	return ctx.NoContent(code)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"github.com/derfetzer/longhorn-monitor/monitor/apiserver"
+	"github.com/rs/zerolog/log"
+
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// actionEvict evicts the pod via the Eviction API so that PodDisruptionBudgets are honoured.
+	actionEvict = "evict"
+	// actionDelete deletes the pod with the configured grace period.
+	actionDelete = "delete"
+	// actionForceDelete deletes the pod immediately, e.g. if it is stuck on an unreachable volume.
+	actionForceDelete = "force-delete"
+)
+
+func isValidAction(action string) bool {
+	return action == actionEvict || action == actionDelete || action == actionForceDelete
+}
+
+// remediationActionFor returns the action used to restart unhealthy pods in the namespace.
+func (cfg *MonitorConfig) remediationActionFor(namespace string) string {
+	if action, p := cfg.NamespaceActions[namespace]; p {
+		return action
+	}
+	return cfg.RemediationAction
+}
+
+// dryRunFor returns whether unhealthy pods in the namespace are only reported
+// instead of restarted.
+func (cfg *MonitorConfig) dryRunFor(namespace string) bool {
+	return cfg.DryRun || cfg.DryRunNamespaces[namespace]
+}
+
+// remediatePod restarts the pod with the given action and returns the action
+// that was actually taken. If the cluster does not support evictions, the pod
+// is deleted instead.
+func remediatePod(clientset kubernetes.Interface, podIdentifier apiserver.PodIdentifier, action string, config *MonitorConfig) (string, error) {
+	podClient := clientset.CoreV1().Pods(podIdentifier.Namespace)
+
+	if action == actionEvict {
+		err := podClient.Evict(&policyv1beta1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      podIdentifier.Name,
+				Namespace: podIdentifier.Namespace,
+			},
+		})
+		if !errors.IsMethodNotSupported(err) {
+			return action, err
+		}
+		log.Warn().
+			Err(err).
+			Interface("podIdentifier", podIdentifier).
+			Msg("Eviction is not supported, falling back to delete")
+		action = actionDelete
+	}
+
+	deleteOptions := &metav1.DeleteOptions{GracePeriodSeconds: config.GracePeriod}
+	if action == actionForceDelete {
+		var gracePeriod int64
+		deleteOptions.GracePeriodSeconds = &gracePeriod
+	}
+	return action, podClient.Delete(podIdentifier.Name, deleteOptions)
+}
+
+// logRemediationResult logs the outcome of remediatePod and reports whether it succeeded.
+func logRemediationResult(podIdentifier apiserver.PodIdentifier, action string, err error) bool {
+	if errors.IsNotFound(err) {
+		log.Warn().
+			Interface("podIdentifier", podIdentifier).
+			Str("action", action).
+			Msg("Pod not found")
+	} else if errors.IsTooManyRequests(err) {
+		log.Warn().
+			Err(err).
+			Interface("podIdentifier", podIdentifier).
+			Str("action", action).
+			Msg("Eviction of pod is blocked by a PodDisruptionBudget")
+	} else if err != nil {
+		log.Error().
+			Err(err).
+			Interface("podIdentifier", podIdentifier).
+			Str("action", action).
+			Msg("Error deleting pod")
+	} else {
+		log.Info().
+			Interface("podIdentifier", podIdentifier).
+			Str("action", action).
+			Msg("Pod deleted")
+		return true
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/derfetzer/longhorn-monitor/monitor/apiserver"
+	"github.com/rs/zerolog/log"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// restartBudget limits the number of concurrent restarts per owner of a pod so
+// that a workload never loses all of its replicas at once. A restart is in
+// flight until a pod of the same owner created after the restart reports
+// healthy or until the timeout elapsed. Deletions blocked by the budget are
+// attempted again after the recheck interval.
+type restartBudget struct {
+	Timeout         time.Duration
+	RecheckInterval time.Duration
+	inFlight        map[string][]time.Time
+	finished        map[string]time.Time
+	lock            sync.Mutex
+}
+
+func newRestartBudget(timeout time.Duration) *restartBudget {
+	return &restartBudget{
+		Timeout:         timeout,
+		RecheckInterval: 10 * time.Second,
+		inFlight:        make(map[string][]time.Time),
+		finished:        make(map[string]time.Time),
+	}
+}
+
+// acquire reserves a restart for the owner if less than maxConcurrent restarts
+// are in flight and the last restart began at least cooldown ago. Pods without
+// owner are not limited, neither is an owner if maxConcurrent is 0.
+func (b *restartBudget) acquire(owner string, now time.Time, maxConcurrent uint32, cooldown time.Duration) bool {
+	if owner == "" {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	restarts := b.inFlight[owner]
+	if maxConcurrent > 0 && uint32(len(restarts)) >= maxConcurrent {
+		return false
+	}
+
+	lastRestart := b.finished[owner]
+	if len(restarts) > 0 && restarts[len(restarts)-1].After(lastRestart) {
+		lastRestart = restarts[len(restarts)-1]
+	}
+	if now.Sub(lastRestart) < cooldown {
+		return false
+	}
+
+	b.inFlight[owner] = append(restarts, now)
+	return true
+}
+
+// cancel gives back the latest restart of the owner, e.g. if the deletion failed.
+func (b *restartBudget) cancel(owner string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if restarts := b.inFlight[owner]; len(restarts) > 0 {
+		b.setInFlight(owner, restarts[:len(restarts)-1])
+	}
+}
+
+// complete finishes the oldest restart of the owner that happened before the
+// replacement pod was created.
+func (b *restartBudget) complete(owner string, createdAt time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	restarts := b.inFlight[owner]
+	for i, restartedAt := range restarts {
+		if restartedAt.Before(createdAt) {
+			b.setInFlight(owner, append(restarts[:i:i], restarts[i+1:]...))
+			b.setFinished(owner, restartedAt)
+			return true
+		}
+	}
+	return false
+}
+
+// expire finishes all restarts whose replacement did not report healthy in time.
+func (b *restartBudget) expire(now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for owner, restarts := range b.inFlight {
+		var remaining []time.Time
+		for _, restartedAt := range restarts {
+			if now.Sub(restartedAt) < b.Timeout {
+				remaining = append(remaining, restartedAt)
+			} else {
+				b.setFinished(owner, restartedAt)
+				log.Warn().
+					Str("owner", owner).
+					Time("restartedAt", restartedAt).
+					Msg("Replacement pod did not report healthy in time")
+			}
+		}
+		b.setInFlight(owner, remaining)
+	}
+}
+
+func (b *restartBudget) setInFlight(owner string, restarts []time.Time) {
+	if len(restarts) == 0 {
+		delete(b.inFlight, owner)
+	} else {
+		b.inFlight[owner] = restarts
+	}
+}
+
+// setFinished remembers the start of the latest finished restart of the owner
+// for its cooldown.
+func (b *restartBudget) setFinished(owner string, restartedAt time.Time) {
+	if restartedAt.After(b.finished[owner]) {
+		b.finished[owner] = restartedAt
+	}
+}
+
+// resolveOwnerRef returns the workload controlling the pod, following a
+// ReplicaSet to its Deployment. It returns nil for pods without controller.
+func resolveOwnerRef(clientset kubernetes.Interface, pod *v1.Pod) (*v1.ObjectReference, error) {
+	ownerRef := metav1.GetControllerOf(pod)
+	if ownerRef == nil {
+		return nil, nil
+	}
+
+	if ownerRef.Kind == "ReplicaSet" {
+		rs, err := clientset.AppsV1().ReplicaSets(pod.Namespace).Get(ownerRef.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if rsOwnerRef := metav1.GetControllerOf(rs); rsOwnerRef != nil && rsOwnerRef.Kind == "Deployment" {
+			ownerRef = rsOwnerRef
+		}
+	}
+
+	return &v1.ObjectReference{
+		APIVersion: ownerRef.APIVersion,
+		Kind:       ownerRef.Kind,
+		Namespace:  pod.Namespace,
+		Name:       ownerRef.Name,
+		UID:        ownerRef.UID,
+	}, nil
+}
+
+// resolveOwner returns the workload controlling the pod as Kind/namespace/name.
+// It returns an empty string for pods without controller.
+func resolveOwner(clientset kubernetes.Interface, pod *v1.Pod) (string, error) {
+	ownerRef, err := resolveOwnerRef(clientset, pod)
+	if ownerRef == nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s/%s", ownerRef.Kind, ownerRef.Namespace, ownerRef.Name), nil
+}
+
+// lookupOwner returns the owner of the pod and its creation time.
+func lookupOwner(clientset kubernetes.Interface, podIdentifier apiserver.PodIdentifier) (string, time.Time) {
+	pod, err := clientset.CoreV1().Pods(podIdentifier.Namespace).Get(podIdentifier.Name, metav1.GetOptions{})
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Interface("podIdentifier", podIdentifier).
+			Msg("Could not get pod to resolve its owner")
+		return "", time.Time{}
+	}
+
+	owner, err := resolveOwner(clientset, pod)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Interface("podIdentifier", podIdentifier).
+			Msg("Could not resolve owner of pod")
+	}
+	return owner, pod.CreationTimestamp.Time
+}
+
+// watchRecoveries returns a channel receiving all pods that report healthy.
+func watchRecoveries(healthMonitor *apiserver.HealthMonitor) <-chan apiserver.PodIdentifier {
+	recoveries := make(chan apiserver.PodIdentifier, 100)
+
+	healthMonitor.AddListener(func(event apiserver.HealthEvent) {
+		if event.Type != apiserver.HealthEventHealthy && event.Type != apiserver.HealthEventRecovered {
+			return
+		}
+		select {
+		case recoveries <- event.Identifier:
+		default:
+			// The restart budget will time out instead.
+			log.Warn().
+				Interface("podIdentifier", event.Identifier).
+				Msg("Dropped recovery of pod")
+		}
+	})
+
+	return recoveries
+}
+
+// completeRestarts finishes the restarts of owners whose replacement pods
+// report healthy and expires the ones that took too long.
+func completeRestarts(recoveries <-chan apiserver.PodIdentifier, clientset kubernetes.Interface, budget *restartBudget) {
+	ticker := time.NewTicker(budget.RecheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case podIdentifier := <-recoveries:
+			owner, createdAt := lookupOwner(clientset, podIdentifier)
+			if owner != "" && budget.complete(owner, createdAt) {
+				log.Info().
+					Interface("podIdentifier", podIdentifier).
+					Str("owner", owner).
+					Msg("Replacement pod reported healthy")
+			}
+		case now := <-ticker.C:
+			budget.expire(now)
+		}
+	}
+}
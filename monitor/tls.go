@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// certReloader serves the certificate in CertFile and KeyFile and reloads it
+// once the files change, so that rotated certificates are picked up without
+// restarting the monitor. If ClientCAFile is set, clients have to present a
+// certificate signed by one of the CAs in it.
+type certReloader struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	cert         *tls.Certificate
+	clientCAs    *x509.CertPool
+	modTime      time.Time
+	lock         sync.RWMutex
+}
+
+func newCertReloader(certFile, keyFile, clientCAFile string) (*certReloader, error) {
+	r := &certReloader{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: clientCAFile,
+	}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the files if they changed since they were last loaded and
+// returns whether they did.
+func (r *certReloader) reload() (bool, error) {
+	var modTime time.Time
+	for _, file := range []string{r.CertFile, r.KeyFile, r.ClientCAFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	r.lock.RLock()
+	unchanged := r.cert != nil && modTime.Equal(r.modTime)
+	r.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("could not load certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.ClientCAFile)
+		if err != nil {
+			return false, fmt.Errorf("could not read client CA: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return false, errors.New("client CA contains no certificate")
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTime = modTime
+	return true, nil
+}
+
+// watch checks the files for changes every interval until the channel is
+// closed. The previous certificate is served as long as the files cannot be
+// loaded, as a rotation may replace them one after the other.
+func (r *certReloader) watch(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			reloaded, err := r.reload()
+			if err != nil {
+				log.Error().
+					Err(err).
+					Str("certFile", r.CertFile).
+					Msg("Could not reload TLS certificate")
+			} else if reloaded {
+				log.Info().
+					Str("certFile", r.CertFile).
+					Msg("Reloaded TLS certificate")
+			}
+		}
+	}
+}
+
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.cert, r.clientCAs
+}
+
+// serverConfig returns the TLS configuration of the API server, which always
+// uses the latest certificate and client CAs.
+func (r *certReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, clientCAs := r.current()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if clientCAs != nil {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = clientCAs
+			}
+			return config, nil
+		},
+	}
+}
+
+// proxyConfig returns the TLS configuration of requests forwarded to the
+// leader. The leader is addressed by its pod IP, which the certificate does
+// not name, so it is verified by presenting the same certificate as this
+// replica. With client authentication enabled, this replica presents its own
+// certificate, which therefore has to be signed by one of the client CAs.
+func (r *certReloader) proxyConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// The certificate is verified by VerifyPeerCertificate instead.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			cert, _ := r.current()
+			if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], cert.Certificate[0]) {
+				return errors.New("leader does not present the certificate of the monitor")
+			}
+			return nil
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+	}
+}
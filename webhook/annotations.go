@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const annotationPrefix = "der-fetzer.de/longhorn-monitor."
+
+// overrideAnnotations are the annotations a pod can use to override the
+// settings of its health check, mapped to the environment variables of the
+// injected container. The threshold and action are read by the monitor from
+// the pod itself, so they are only validated.
+var overrideAnnotations = []struct {
+	annotation string
+	env        string
+	validate   func(value string) error
+}{
+	{annotationPrefix + "threshold", "", validatePositive},
+	{annotationPrefix + "interval", "INTERVAL", validatePositive},
+	{annotationPrefix + "timeout", "TIMEOUT", validatePositive},
+	{annotationPrefix + "action", "", validateAction},
+	{annotationPrefix + "latency-warn-ms", "LATENCY_WARN_MS", validatePositive},
+	{annotationPrefix + "latency-fail-ms", "LATENCY_FAIL_MS", validatePositive},
+}
+
+func validatePositive(value string) error {
+	v, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return err
+	}
+	if v == 0 {
+		return fmt.Errorf("has to be greater than 0")
+	}
+	return nil
+}
+
+func validateAction(value string) error {
+	switch value {
+	case "evict", "delete", "force-delete", "none":
+		return nil
+	}
+	return fmt.Errorf("has to be one of evict, delete, force-delete or none")
+}
+
+// volumeNames parses the comma separated list of volumes to check and
+// validates that the pod has each of them.
+func volumeNames(value string, pod *corev1.Pod) ([]string, error) {
+	podVolumes := make(map[string]bool)
+	for _, volume := range pod.Spec.Volumes {
+		podVolumes[volume.Name] = true
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		if !podVolumes[name] {
+			return nil, fmt.Errorf("pod has no volume %q", name)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no volume to check in annotation %q", value)
+	}
+	return names, nil
+}
+
+// overrideEnv validates the override annotations of the pod and returns them
+// as environment variables for the health check container.
+func overrideEnv(annotations map[string]string) ([]corev1.EnvVar, error) {
+	var env []corev1.EnvVar
+	for _, override := range overrideAnnotations {
+		value, ok := annotations[override.annotation]
+		if !ok {
+			continue
+		}
+		if err := override.validate(value); err != nil {
+			return nil, fmt.Errorf("invalid annotation %s=%q: %v", override.annotation, value, err)
+		}
+		if override.env != "" {
+			env = append(env, corev1.EnvVar{Name: override.env, Value: value})
+		}
+	}
+
+	interval, hasInterval := annotations[annotationPrefix+"interval"]
+	timeout, hasTimeout := annotations[annotationPrefix+"timeout"]
+	if hasInterval && hasTimeout {
+		i, _ := strconv.ParseUint(interval, 10, 32)
+		t, _ := strconv.ParseUint(timeout, 10, 32)
+		if t >= i {
+			return nil, fmt.Errorf("timeout of %s seconds has to be shorter than the interval of %s seconds", timeout, interval)
+		}
+	}
+
+	return env, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestOverrideEnv(t *testing.T) {
+	env, err := overrideEnv(map[string]string{
+		"der-fetzer.de/longhorn-monitor.volume-name":     "data",
+		"der-fetzer.de/longhorn-monitor.threshold":       "10",
+		"der-fetzer.de/longhorn-monitor.interval":        "30",
+		"der-fetzer.de/longhorn-monitor.timeout":         "5",
+		"der-fetzer.de/longhorn-monitor.action":          "delete",
+		"der-fetzer.de/longhorn-monitor.latency-fail-ms": "1000",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []corev1.EnvVar{
+		{Name: "INTERVAL", Value: "30"},
+		{Name: "TIMEOUT", Value: "5"},
+		{Name: "LATENCY_FAIL_MS", Value: "1000"},
+	}
+	if !reflect.DeepEqual(expected, env) {
+		t.Errorf("expected %v, got %v", expected, env)
+	}
+
+	invalid := []map[string]string{
+		{"der-fetzer.de/longhorn-monitor.threshold": "0"},
+		{"der-fetzer.de/longhorn-monitor.interval": "soon"},
+		{"der-fetzer.de/longhorn-monitor.timeout": "-1"},
+		{"der-fetzer.de/longhorn-monitor.action": "reboot"},
+		{"der-fetzer.de/longhorn-monitor.interval": "10", "der-fetzer.de/longhorn-monitor.timeout": "10"},
+	}
+	for _, annotations := range invalid {
+		if _, err := overrideEnv(annotations); err == nil {
+			t.Errorf("expected error for %v", annotations)
+		}
+	}
+}
+
+func TestVolumeNames(t *testing.T) {
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Volumes: []corev1.Volume{{Name: "data"}, {Name: "wal"}, {Name: "config"}},
+		},
+	}
+
+	names, err := volumeNames(" data, wal,data", pod)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"data", "wal"}; !reflect.DeepEqual(expected, names) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+
+	for _, value := range []string{"", " , ", "data,logs"} {
+		if _, err := volumeNames(value, pod); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	longhornProvisioner = "driver.longhorn.io"
+
+	// autoDiscoverLabel enables the auto-discovery of Longhorn volumes for all
+	// pods of a namespace.
+	autoDiscoverLabel = annotationPrefix + "auto-discover"
+)
+
+// discovery resolves the volumes of pods that are provisioned by Longhorn.
+type discovery struct {
+	clientset kubernetes.Interface
+	global    bool
+}
+
+// enabled returns whether volumes are discovered in the namespace, either
+// because it is enabled globally or because the namespace has opted in.
+func (d *discovery) enabled(namespace string) (bool, error) {
+	if d.global {
+		return true, nil
+	}
+
+	ns, err := d.clientset.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	return ns.Labels[autoDiscoverLabel] == "true", nil
+}
+
+// longhornVolumes returns the names of the volumes of the pod that are backed
+// by a persistent volume claim provisioned by Longhorn.
+func (d *discovery) longhornVolumes(pod *corev1.Pod, namespace string) ([]string, error) {
+	var names []string
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil {
+			continue
+		}
+
+		isLonghorn, err := d.isLonghornClaim(namespace, volume.PersistentVolumeClaim.ClaimName)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve volume %q: %v", volume.Name, err)
+		}
+		if isLonghorn {
+			names = append(names, volume.Name)
+		}
+	}
+	return names, nil
+}
+
+// isLonghornClaim checks the driver of the persistent volume a claim is bound
+// to or, for claims that are not bound yet, the provisioner of its storage class.
+func (d *discovery) isLonghornClaim(namespace, claimName string) (bool, error) {
+	pvc, err := d.clientset.CoreV1().PersistentVolumeClaims(namespace).Get(claimName, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	if pvc.Spec.VolumeName != "" {
+		pv, err := d.clientset.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return pv.Spec.CSI != nil && pv.Spec.CSI.Driver == longhornProvisioner, nil
+	}
+
+	storageClassName := pvc.Spec.StorageClassName
+	if storageClassName == nil {
+		// Claims without a storage class are provisioned by the default one.
+		return d.isLonghornDefaultStorageClass()
+	}
+	if *storageClassName == "" {
+		return false, nil
+	}
+
+	storageClass, err := d.clientset.StorageV1().StorageClasses().Get(*storageClassName, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	return storageClass.Provisioner == longhornProvisioner, nil
+}
+
+func (d *discovery) isLonghornDefaultStorageClass() (bool, error) {
+	storageClasses, err := d.clientset.StorageV1().StorageClasses().List(metav1.ListOptions{})
+	if err != nil {
+		return false, err
+	}
+	for _, storageClass := range storageClasses.Items {
+		if storageClass.Annotations["storageclass.kubernetes.io/is-default-class"] == "true" {
+			return storageClass.Provisioner == longhornProvisioner, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func claimVolume(name, claimName string) corev1.Volume {
+	return corev1.Volume{
+		Name: name,
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+		},
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	longhorn, nfs := "longhorn", "nfs"
+	clientset := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "enabled", Labels: map[string]string{autoDiscoverLabel: "true"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "disabled"}},
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: longhorn}, Provisioner: longhornProvisioner},
+		&storagev1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: nfs, Annotations: map[string]string{"storageclass.kubernetes.io/is-default-class": "true"}},
+			Provisioner: "example.com/nfs",
+		},
+		&corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-data"},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					CSI: &corev1.CSIPersistentVolumeSource{Driver: longhornProvisioner},
+				},
+			},
+		},
+		&corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "enabled"},
+			Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pv-data"},
+		},
+		&corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "wal", Namespace: "enabled"},
+			Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: &longhorn},
+		},
+		&corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "backup", Namespace: "enabled"},
+			Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: &nfs},
+		},
+		&corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "enabled"},
+		},
+	)
+	d := &discovery{clientset: clientset}
+
+	for namespace, expected := range map[string]bool{"enabled": true, "disabled": false} {
+		enabled, err := d.enabled(namespace)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if enabled != expected {
+			t.Errorf("expected auto-discovery of namespace %s to be %v", namespace, expected)
+		}
+	}
+
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Volumes: []corev1.Volume{
+				claimVolume("data", "data"),
+				claimVolume("wal", "wal"),
+				claimVolume("backup", "backup"),
+				claimVolume("default", "default"),
+				{Name: "cache", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+			},
+		},
+	}
+
+	names, err := d.longhornVolumes(pod, "enabled")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"data", "wal"}; !reflect.DeepEqual(expected, names) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+
+	pod.Spec.Volumes = append(pod.Spec.Volumes, claimVolume("missing", "missing"))
+	if _, err := d.longhornVolumes(pod, "enabled"); err == nil {
+		t.Error("expected error for missing claim")
+	}
+
+	// An explicit annotation takes precedence over the discovery.
+	pod.Annotations = map[string]string{volumeNameAnnotation: "backup"}
+	names, err = checkedVolumes(pod, "enabled", d, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"backup"}; !reflect.DeepEqual(expected, names) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+}
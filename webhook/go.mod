@@ -4,6 +4,7 @@ go 1.14
 
 require (
 	github.com/slok/kubewebhook v0.7.0
-	k8s.io/api v0.16.7
-	k8s.io/apimachinery v0.16.8-beta.0
+	k8s.io/api v0.16.8
+	k8s.io/apimachinery v0.16.8
+	k8s.io/client-go v0.16.8
 )
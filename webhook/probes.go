@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// defaultStatusPort is the port the health check serves its liveness and
+// readiness endpoints on, unless configured otherwise.
+const defaultStatusPort = 8081
+
+const (
+	readinessProbeAnnotation = annotationPrefix + "readiness-probe"
+	statusPortAnnotation     = annotationPrefix + "status-port"
+)
+
+// Modes of wiring the readiness probes.
+const (
+	// readinessProbeNone does not wire any probes.
+	readinessProbeNone = "none"
+	// readinessProbeSidecar wires the probes of the health check container.
+	readinessProbeSidecar = "sidecar"
+	// readinessProbeAll additionally wires the readiness probe of app
+	// containers without own readiness probe.
+	readinessProbeAll = "all"
+)
+
+func validateReadinessProbe(value string) error {
+	switch value {
+	case readinessProbeNone, readinessProbeSidecar, readinessProbeAll:
+		return nil
+	}
+	return fmt.Errorf("has to be one of %s, %s or %s", readinessProbeNone, readinessProbeSidecar, readinessProbeAll)
+}
+
+// readinessProbeMode returns the mode of the pod, which defaults to the global
+// mode.
+func readinessProbeMode(annotations map[string]string, defaultMode string) (string, error) {
+	mode, ok := annotations[readinessProbeAnnotation]
+	if !ok {
+		return defaultMode, nil
+	}
+	if err := validateReadinessProbe(mode); err != nil {
+		return "", fmt.Errorf("invalid annotation %s: %v", readinessProbeAnnotation, err)
+	}
+	return mode, nil
+}
+
+func validatePort(value string) error {
+	v, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return err
+	}
+	if v == 0 {
+		return fmt.Errorf("has to be greater than 0")
+	}
+	return nil
+}
+
+// declaresPort returns whether a container of the pod declares the port. The
+// containers of a pod share its network namespace, so the health check cannot
+// use such a port.
+func declaresPort(pod *corev1.Pod, port int) bool {
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, container := range containers {
+			for _, containerPort := range container.Ports {
+				if int(containerPort.ContainerPort) == port {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// statusPort returns the port of the status endpoints of the pod, which
+// defaults to the global port. It returns 0 if a container of the pod already
+// declares the global port, while a port in the annotation that is declared
+// by a container is rejected.
+func statusPort(pod *corev1.Pod, defaultPort int) (int, error) {
+	value, ok := pod.Annotations[statusPortAnnotation]
+	if !ok {
+		if declaresPort(pod, defaultPort) {
+			return 0, nil
+		}
+		return defaultPort, nil
+	}
+	if err := validatePort(value); err != nil {
+		return 0, fmt.Errorf("invalid annotation %s=%q: %v", statusPortAnnotation, value, err)
+	}
+	port, _ := strconv.Atoi(value)
+	if declaresPort(pod, port) {
+		return 0, fmt.Errorf("invalid annotation %s=%q: port is used by a container of the pod", statusPortAnnotation, value)
+	}
+	return port, nil
+}
+
+func statusProbe(path string, port int) *corev1.Probe {
+	return &corev1.Probe{
+		Handler: corev1.Handler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path: path,
+				Port: intstr.FromInt(port),
+			},
+		},
+		PeriodSeconds:    10,
+		FailureThreshold: 3,
+	}
+}
+
+// wireProbes enables the status endpoints of the health check on the port and
+// wires the probes of the pod according to the mode. Existing readiness probes
+// of app containers are kept.
+func wireProbes(mode string, port int, pod *corev1.Pod, container *corev1.Container) {
+	if mode == readinessProbeNone {
+		return
+	}
+
+	container.Env = append(container.Env, corev1.EnvVar{Name: "STATUS_PORT", Value: strconv.Itoa(port)})
+	container.LivenessProbe = statusProbe("/livez", port)
+	container.ReadinessProbe = statusProbe("/readyz", port)
+
+	if mode == readinessProbeAll {
+		for i := range pod.Spec.Containers {
+			if pod.Spec.Containers[i].ReadinessProbe == nil {
+				pod.Spec.Containers[i].ReadinessProbe = statusProbe("/readyz", port)
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWireProbes(t *testing.T) {
+	ownProbe := statusProbe("/healthz", 8080)
+	newPod := func() *corev1.Pod {
+		return &corev1.Pod{
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{Name: "app"},
+					{Name: "proxy", ReadinessProbe: ownProbe},
+				},
+			},
+		}
+	}
+
+	pod, container := newPod(), &corev1.Container{}
+	wireProbes(readinessProbeNone, defaultStatusPort, pod, container)
+	if container.ReadinessProbe != nil || len(container.Env) != 0 || pod.Spec.Containers[0].ReadinessProbe != nil {
+		t.Error("expected no probes to be wired")
+	}
+
+	pod, container = newPod(), &corev1.Container{}
+	wireProbes(readinessProbeSidecar, 9000, pod, container)
+	if container.ReadinessProbe == nil || container.LivenessProbe == nil {
+		t.Error("expected probes of the health check to be wired")
+	}
+	if port := container.ReadinessProbe.HTTPGet.Port.IntValue(); port != 9000 {
+		t.Errorf("expected probe on port 9000, got %d", port)
+	}
+	if len(container.Env) != 1 || container.Env[0].Name != "STATUS_PORT" || container.Env[0].Value != "9000" {
+		t.Errorf("expected status port to be set, got %v", container.Env)
+	}
+	if pod.Spec.Containers[0].ReadinessProbe != nil {
+		t.Error("expected no probe of the app container")
+	}
+
+	pod, container = newPod(), &corev1.Container{}
+	wireProbes(readinessProbeAll, defaultStatusPort, pod, container)
+	if probe := pod.Spec.Containers[0].ReadinessProbe; probe == nil || probe.HTTPGet.Path != "/readyz" {
+		t.Errorf("expected readiness probe of the app container, got %v", probe)
+	}
+	if pod.Spec.Containers[1].ReadinessProbe != ownProbe {
+		t.Error("expected own readiness probe to be kept")
+	}
+}
+
+func TestStatusPort(t *testing.T) {
+	newPod := func(annotations map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: annotations},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{Name: "app", Ports: []corev1.ContainerPort{{ContainerPort: 8081}}},
+				},
+			},
+		}
+	}
+
+	if port, err := statusPort(newPod(nil), 9000); err != nil || port != 9000 {
+		t.Errorf("expected global port, got %d %v", port, err)
+	}
+	if port, err := statusPort(newPod(map[string]string{statusPortAnnotation: "9100"}), 9000); err != nil || port != 9100 {
+		t.Errorf("expected port of annotation, got %d %v", port, err)
+	}
+
+	// The global port is not used if the app declares it
+	if port, err := statusPort(newPod(nil), 8081); err != nil || port != 0 {
+		t.Errorf("expected no port, got %d %v", port, err)
+	}
+
+	for _, value := range []string{"8081", "0", "70000", "http"} {
+		if _, err := statusPort(newPod(map[string]string{statusPortAnnotation: value}), 9000); err == nil {
+			t.Errorf("expected error for port %q", value)
+		}
+	}
+}
+
+func TestReadinessProbeMode(t *testing.T) {
+	if mode, err := readinessProbeMode(nil, readinessProbeSidecar); err != nil || mode != readinessProbeSidecar {
+		t.Errorf("expected default mode, got %q %v", mode, err)
+	}
+	if mode, err := readinessProbeMode(map[string]string{readinessProbeAnnotation: "all"}, readinessProbeNone); err != nil || mode != readinessProbeAll {
+		t.Errorf("expected mode of annotation, got %q %v", mode, err)
+	}
+	if _, err := readinessProbeMode(map[string]string{readinessProbeAnnotation: "app"}, readinessProbeNone); err == nil {
+		t.Error("expected error for invalid mode")
+	}
+}
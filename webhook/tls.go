@@ -0,0 +1,42 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	clientCertVolumeName = "longhorn-monitor-client-cert"
+	clientCertMountPath  = "/var/run/secrets/longhorn-monitor-tls"
+)
+
+// configureTLS passes the CA bundle the monitor is verified with to the
+// health check container. If clientCertSecret is set, the kubernetes.io/tls
+// secret of that name in the namespace of the pod is mounted as the client
+// certificate presented to the monitor. The secret is optional, so that a
+// namespace without it only breaks the health check and not the pod.
+func configureTLS(caBundle, clientCertSecret string, pod *corev1.Pod, container *corev1.Container) {
+	if caBundle != "" {
+		container.Env = append(container.Env, corev1.EnvVar{Name: "TLS_CA", Value: caBundle})
+	}
+
+	if clientCertSecret == "" {
+		return
+	}
+
+	optional := true
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: clientCertVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: clientCertSecret, Optional: &optional},
+		},
+	})
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      clientCertVolumeName,
+		MountPath: clientCertMountPath,
+		ReadOnly:  true,
+	})
+	container.Env = append(container.Env,
+		corev1.EnvVar{Name: "TLS_CERT_FILE", Value: clientCertMountPath + "/" + corev1.TLSCertKey},
+		corev1.EnvVar{Name: "TLS_KEY_FILE", Value: clientCertMountPath + "/" + corev1.TLSPrivateKeyKey},
+	)
+}
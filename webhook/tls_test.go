@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestConfigureTLS(t *testing.T) {
+	tests := []struct {
+		name             string
+		caBundle         string
+		clientCertSecret string
+		expectedEnv      []corev1.EnvVar
+		expectedVolumes  int
+	}{
+		{
+			name: "plain http",
+		},
+		{
+			name:        "ca bundle",
+			caBundle:    "ca",
+			expectedEnv: []corev1.EnvVar{{Name: "TLS_CA", Value: "ca"}},
+		},
+		{
+			name:             "client certificate",
+			caBundle:         "ca",
+			clientCertSecret: "monitor-client",
+			expectedEnv: []corev1.EnvVar{
+				{Name: "TLS_CA", Value: "ca"},
+				{Name: "TLS_CERT_FILE", Value: "/var/run/secrets/longhorn-monitor-tls/tls.crt"},
+				{Name: "TLS_KEY_FILE", Value: "/var/run/secrets/longhorn-monitor-tls/tls.key"},
+			},
+			expectedVolumes: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{}
+			container := &corev1.Container{}
+
+			configureTLS(tt.caBundle, tt.clientCertSecret, pod, container)
+
+			if !reflect.DeepEqual(container.Env, tt.expectedEnv) {
+				t.Errorf("expected env %v, got %v", tt.expectedEnv, container.Env)
+			}
+			if len(pod.Spec.Volumes) != tt.expectedVolumes || len(container.VolumeMounts) != tt.expectedVolumes {
+				t.Fatalf("expected %d volumes, got %v and %v", tt.expectedVolumes, pod.Spec.Volumes, container.VolumeMounts)
+			}
+			if tt.expectedVolumes > 0 && pod.Spec.Volumes[0].Secret.SecretName != tt.clientCertSecret {
+				t.Errorf("expected secret %s, got %v", tt.clientCertSecret, pod.Spec.Volumes[0])
+			}
+			// A missing secret must not keep the pod from starting
+			if tt.expectedVolumes > 0 && (pod.Spec.Volumes[0].Secret.Optional == nil || !*pod.Spec.Volumes[0].Secret.Optional) {
+				t.Errorf("expected optional secret, got %v", pod.Spec.Volumes[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	tokenVolumeName = "longhorn-monitor-token"
+	tokenMountPath  = "/var/run/secrets/longhorn-monitor"
+	tokenPath       = "token"
+
+	// tokenExpirationSeconds is the lifetime of the token, which the kubelet
+	// rotates before it expires.
+	tokenExpirationSeconds = 3600
+)
+
+// mountToken projects a ServiceAccount token bound to the pod and to the
+// audience of the monitor into the health check container, which sends it to
+// authenticate its reports.
+func mountToken(audience string, pod *corev1.Pod, container *corev1.Container) {
+	expirationSeconds := int64(tokenExpirationSeconds)
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: tokenVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{
+					{
+						ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+							Audience:          audience,
+							ExpirationSeconds: &expirationSeconds,
+							Path:              tokenPath,
+						},
+					},
+				},
+			},
+		},
+	})
+
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      tokenVolumeName,
+		MountPath: tokenMountPath,
+		ReadOnly:  true,
+	})
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name:  "TOKEN_FILE",
+		Value: tokenMountPath + "/" + tokenPath,
+	})
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestMountToken(t *testing.T) {
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Volumes: []corev1.Volume{{Name: "data"}},
+		},
+	}
+	container := &corev1.Container{}
+
+	mountToken("longhorn-monitor", pod, container)
+
+	if len(pod.Spec.Volumes) != 2 {
+		t.Fatalf("expected token volume to be added, got %v", pod.Spec.Volumes)
+	}
+	projected := pod.Spec.Volumes[1].Projected
+	if projected == nil || len(projected.Sources) != 1 || projected.Sources[0].ServiceAccountToken == nil {
+		t.Fatalf("expected projected token, got %v", pod.Spec.Volumes[1])
+	}
+	if audience := projected.Sources[0].ServiceAccountToken.Audience; audience != "longhorn-monitor" {
+		t.Errorf("expected audience longhorn-monitor, got %s", audience)
+	}
+
+	if len(container.VolumeMounts) != 1 || container.VolumeMounts[0].Name != tokenVolumeName || !container.VolumeMounts[0].ReadOnly {
+		t.Errorf("expected read-only mount of the token, got %v", container.VolumeMounts)
+	}
+	if len(container.Env) != 1 || container.Env[0].Value != "/var/run/secrets/longhorn-monitor/token" {
+		t.Errorf("expected path of the token, got %v", container.Env)
+	}
+}
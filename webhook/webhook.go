@@ -6,20 +6,33 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 
 	whhttp "github.com/slok/kubewebhook/pkg/http"
 	"github.com/slok/kubewebhook/pkg/log"
+	whcontext "github.com/slok/kubewebhook/pkg/webhook/context"
 	mutatingwh "github.com/slok/kubewebhook/pkg/webhook/mutating"
 )
 
+const volumeNameAnnotation = annotationPrefix + "volume-name"
+
 type config struct {
 	certFile         string
 	keyFile          string
 	monitorSvc       string
 	healthcheckImage string
+	autoDiscover     bool
+	readinessProbe   string
+	statusPort       int
+	tokenAudience    string
+	monitorCABundle  string
+	clientCertSecret string
 }
 
 func initFlags() *config {
@@ -43,49 +56,177 @@ func initFlags() *config {
 		cfg.healthcheckImage = "derfetzer/longhorn-monitor:dev"
 	}
 
+	if v, p := os.LookupEnv("AUTO_DISCOVER"); p {
+		conv, err := strconv.ParseBool(v)
+		if err != nil {
+			panic("AUTO_DISCOVER environment variable could not be parsed!")
+		}
+		cfg.autoDiscover = conv
+	}
+
+	if v, p := os.LookupEnv("TOKEN_AUDIENCE"); p {
+		cfg.tokenAudience = v
+	} else {
+		cfg.tokenAudience = "longhorn-monitor"
+	}
+
+	cfg.monitorCABundle = os.Getenv("MONITOR_CA_BUNDLE")
+	cfg.clientCertSecret = os.Getenv("MONITOR_CLIENT_CERT_SECRET")
+
+	if v, p := os.LookupEnv("READINESS_PROBE"); p {
+		if err := validateReadinessProbe(v); err != nil {
+			panic(fmt.Sprintf("READINESS_PROBE environment variable %s!", err))
+		}
+		cfg.readinessProbe = v
+	} else {
+		cfg.readinessProbe = readinessProbeNone
+	}
+
+	if v, p := os.LookupEnv("STATUS_PORT"); p {
+		if err := validatePort(v); err != nil {
+			panic("STATUS_PORT environment variable could not be parsed!")
+		}
+		cfg.statusPort, _ = strconv.Atoi(v)
+	} else {
+		cfg.statusPort = defaultStatusPort
+	}
+
 	return cfg
 }
 
+func initKubernetes() kubernetes.Interface {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		panic(fmt.Sprintf("could not create in-cluster config: %s", err))
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		panic(fmt.Sprintf("could not create clientset: %s", err))
+	}
+	return clientset
+}
+
+// checkedVolumes returns the volumes of the pod to check. The volumes listed in
+// the annotation take precedence, otherwise the volumes provisioned by Longhorn
+// are checked if auto-discovery is enabled for the namespace of the pod.
+func checkedVolumes(pod *corev1.Pod, namespace string, discovery *discovery, logger log.Logger) ([]string, error) {
+	if value, ok := pod.Annotations[volumeNameAnnotation]; ok {
+		return volumeNames(value, pod)
+	}
+
+	enabled, err := discovery.enabled(namespace)
+	if err != nil {
+		// Pods are never rejected because the volumes could not be discovered.
+		logger.Errorf("could not check auto-discovery of namespace %s: %s", namespace, err)
+		return nil, nil
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	names, err := discovery.longhornVolumes(pod, namespace)
+	if err != nil {
+		logger.Errorf("could not discover volumes of pod in namespace %s: %s", namespace, err)
+		return nil, nil
+	}
+	return names, nil
+}
+
 func main() {
 	logger := &log.Std{Debug: true}
 
 	cfg := initFlags()
+	discovery := &discovery{clientset: initKubernetes(), global: cfg.autoDiscover}
 
 	// Create our mutator
-	mt := mutatingwh.MutatorFunc(func(_ context.Context, obj metav1.Object) (bool, error) {
+	mt := mutatingwh.MutatorFunc(func(ctx context.Context, obj metav1.Object) (bool, error) {
 		pod, ok := obj.(*corev1.Pod)
 		if !ok {
 			// If not a pod just continue the mutation chain(if there is one) and don't do nothing.
 			return false, nil
 		}
 
-		if pod.Annotations != nil {
-			if name, ok := pod.Annotations["der-fetzer.de/longhorn-monitor.volume-name"]; ok {
-				container := corev1.Container{
-					Name:    "pvc-health-check",
-					Image:   cfg.healthcheckImage,
-					Command: []string{"/usr/local/bin/longhorn-monitor/healthcheck"},
-					Env: []corev1.EnvVar{
-						corev1.EnvVar{
-							Name: "NAMESPACE",
-							ValueFrom: &corev1.EnvVarSource{
-								FieldRef: &corev1.ObjectFieldSelector{
-									FieldPath: "metadata.namespace",
-								},
-							},
+		// Pods created by controllers have no namespace yet.
+		namespace := pod.Namespace
+		if namespace == "" {
+			if ar := whcontext.GetAdmissionRequest(ctx); ar != nil {
+				namespace = ar.Namespace
+			}
+		}
+
+		names, err := checkedVolumes(pod, namespace, discovery, logger)
+		if err != nil {
+			return false, err
+		}
+
+		if len(names) == 0 {
+			return false, nil
+		}
+
+		overrides, err := overrideEnv(pod.Annotations)
+		if err != nil {
+			return false, err
+		}
+
+		probeMode, err := readinessProbeMode(pod.Annotations, cfg.readinessProbe)
+		if err != nil {
+			return false, err
+		}
+
+		port, err := statusPort(pod, cfg.statusPort)
+		if err != nil {
+			return false, err
+		}
+		if port == 0 && probeMode != readinessProbeNone {
+			// The pod is not rejected for using the global port.
+			logger.Warningf("status port %d is used by a container of the pod, not wiring probes", cfg.statusPort)
+			probeMode = readinessProbeNone
+		}
+
+		container := corev1.Container{
+			Name:    "pvc-health-check",
+			Image:   cfg.healthcheckImage,
+			Command: []string{"/usr/local/bin/longhorn-monitor/healthcheck"},
+			Env: []corev1.EnvVar{
+				corev1.EnvVar{
+					Name: "NAMESPACE",
+					ValueFrom: &corev1.EnvVarSource{
+						FieldRef: &corev1.ObjectFieldSelector{
+							FieldPath: "metadata.namespace",
 						},
-						corev1.EnvVar{
-							Name:  "MONITOR_SVC",
-							Value: cfg.monitorSvc,
+					},
+				},
+				corev1.EnvVar{
+					Name: "POD_UID",
+					ValueFrom: &corev1.EnvVarSource{
+						FieldRef: &corev1.ObjectFieldSelector{
+							FieldPath: "metadata.uid",
 						},
 					},
-					VolumeMounts: []corev1.VolumeMount{corev1.VolumeMount{MountPath: "/pvc", Name: name}},
-				}
+				},
+				corev1.EnvVar{
+					Name:  "MONITOR_SVC",
+					Value: cfg.monitorSvc,
+				},
+				corev1.EnvVar{
+					Name:  "VOLUME_NAMES",
+					Value: strings.Join(names, ","),
+				},
+			},
+		}
+		container.Env = append(container.Env, overrides...)
 
-				pod.Spec.Containers = append(pod.Spec.Containers, container)
-			}
+		// Each volume is mounted at /pvc/<volume>
+		for _, name := range names {
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{MountPath: "/pvc/" + name, Name: name})
 		}
 
+		wireProbes(probeMode, port, pod, &container)
+		mountToken(cfg.tokenAudience, pod, &container)
+		configureTLS(cfg.monitorCABundle, cfg.clientCertSecret, pod, &container)
+
+		pod.Spec.Containers = append(pod.Spec.Containers, container)
+
 		return false, nil
 	})
 